@@ -1,47 +1,3290 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 type Task struct {
-	ID     string `json:"id"`
-	Title  string `json:"title"`
-	Status string `json:"status"`
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	Status    string    `json:"status"`
+	Priority  int       `json:"priority"`
+	Tags      []string  `json:"tags,omitempty"`
+	Version   int       `json:"version"`
+	ParentID  string    `json:"parent_id,omitempty"`
+	Assignee  string    `json:"assignee,omitempty"`
+	Archived  bool      `json:"archived"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+
+	minPriority = 0
+	maxPriority = 5
+
+	shutdownTimeout = 10 * time.Second
+	streamKeepAlive = 15 * time.Second
+	jsonlFlushEvery = 100
+)
+
 var (
-	tasks = make(map[string]Task)
+	ErrNotFound = errors.New("task not found")
+	ErrConflict = errors.New("task already exists")
+	ErrParent   = errors.New("invalid parent")
+
+	ErrVersionMismatch = errors.New("version mismatch")
+	errVersionRequired = errors.New("If-Match header or version field required")
+)
+
+type TaskStore interface {
+	Get(ctx context.Context, id string) (Task, error)
+	List(ctx context.Context) ([]Task, error)
+	Create(ctx context.Context, ts ...Task) error
+	CheckCreate(ctx context.Context, ts ...Task) error
+	Update(ctx context.Context, id string, fn func(*Task) error) (Task, error)
+	UpdateMany(ctx context.Context, ids []string, fn func(*Task) error) (updated []Task, missing []string, err error)
+	Archive(ctx context.Context, id string) (Task, error)
+	Clear(ctx context.Context) error
+	Replace(ctx context.Context, ts []Task) error
+	Count(ctx context.Context, status string, includeArchived bool) (TaskCounts, error)
+}
+
+type TaskCounts struct {
+	Total    int            `json:"total"`
+	ByStatus map[string]int `json:"by_status"`
+}
+
+type memStore struct {
 	mu    sync.RWMutex
+	tasks map[string]Task
+
+	path   string
+	saveMu sync.Mutex
+}
+
+func newMemStore(path string) *memStore {
+	return &memStore{tasks: make(map[string]Task), path: path}
+}
+
+func (s *memStore) Get(ctx context.Context, id string) (Task, error) {
+	if err := ctx.Err(); err != nil {
+		return Task{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.tasks[id]
+	if !ok {
+		return Task{}, ErrNotFound
+	}
+	return t, nil
+}
+
+func (s *memStore) List(ctx context.Context) ([]Task, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]Task, 0, len(s.tasks))
+	for _, t := range s.tasks {
+		list = append(list, t)
+	}
+	return list, nil
+}
+
+func (s *memStore) Create(ctx context.Context, ts ...Task) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if err := s.checkCreate(ts); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	for _, t := range ts {
+		s.tasks[t.ID] = t
+	}
+	s.mu.Unlock()
+	return s.persist()
+}
+
+func (s *memStore) CheckCreate(ctx context.Context, ts ...Task) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.checkCreate(ts)
+}
+
+// checkCreate reports whether ts could be inserted as a batch. The caller must
+// hold s.mu.
+func (s *memStore) checkCreate(ts []Task) error {
+	batch := make(map[string]Task, len(ts))
+	for _, t := range ts {
+		if _, ok := s.tasks[t.ID]; ok {
+			return fmt.Errorf("%w: %s", ErrConflict, t.ID)
+		}
+		batch[t.ID] = t
+	}
+	lookup := func(id string) (Task, bool) {
+		if t, ok := batch[id]; ok {
+			return t, true
+		}
+		return s.lookup(id)
+	}
+	for _, t := range ts {
+		if err := checkParent(t, lookup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memStore) Update(ctx context.Context, id string, fn func(*Task) error) (Task, error) {
+	if err := ctx.Err(); err != nil {
+		return Task{}, err
+	}
+	s.mu.Lock()
+	t, ok := s.tasks[id]
+	if !ok {
+		s.mu.Unlock()
+		return Task{}, ErrNotFound
+	}
+	version := t.Version
+	if err := fn(&t); err != nil {
+		s.mu.Unlock()
+		return Task{}, err
+	}
+	t.ID = id
+	t.Version = version + 1
+	if err := checkParent(t, s.lookup); err != nil {
+		s.mu.Unlock()
+		return Task{}, err
+	}
+	s.tasks[id] = t
+	s.mu.Unlock()
+	if err := s.persist(); err != nil {
+		return Task{}, err
+	}
+	return t, nil
+}
+
+func (s *memStore) UpdateMany(ctx context.Context, ids []string, fn func(*Task) error) ([]Task, []string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	s.mu.Lock()
+	updated := make([]Task, 0, len(ids))
+	missing := make([]string, 0)
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		t, ok := s.tasks[id]
+		if !ok {
+			missing = append(missing, id)
+			continue
+		}
+		version := t.Version
+		if err := fn(&t); err != nil {
+			s.mu.Unlock()
+			return nil, nil, fmt.Errorf("task %s: %w", id, err)
+		}
+		t.ID = id
+		t.Version = version + 1
+		if err := checkParent(t, s.lookup); err != nil {
+			s.mu.Unlock()
+			return nil, nil, err
+		}
+		updated = append(updated, t)
+	}
+	for _, t := range updated {
+		s.tasks[t.ID] = t
+	}
+	s.mu.Unlock()
+	if len(updated) > 0 {
+		if err := s.persist(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return updated, missing, nil
+}
+
+func (s *memStore) lookup(id string) (Task, bool) {
+	t, ok := s.tasks[id]
+	return t, ok
+}
+
+// checkParent verifies that t's parent exists and that following parent links
+// from t never leads back to t.
+func checkParent(t Task, lookup func(string) (Task, bool)) error {
+	seen := map[string]bool{t.ID: true}
+	for id := t.ParentID; id != ""; {
+		if seen[id] {
+			return fmt.Errorf("%w: %s would create a cycle", ErrParent, t.ParentID)
+		}
+		seen[id] = true
+		parent, ok := lookup(id)
+		if !ok {
+			return fmt.Errorf("%w: task %s not found", ErrParent, id)
+		}
+		id = parent.ParentID
+	}
+	return nil
+}
+
+func (s *memStore) Archive(ctx context.Context, id string) (Task, error) {
+	return s.Update(ctx, id, func(t *Task) error {
+		t.Archived = true
+		t.UpdatedAt = time.Now().UTC()
+		return nil
+	})
+}
+
+func (s *memStore) Clear(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.tasks = make(map[string]Task)
+	s.mu.Unlock()
+	return s.persist()
+}
+
+// Replace swaps in ts as the entire task set once every parent link in it
+// resolves.
+func (s *memStore) Replace(ctx context.Context, ts []Task) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tasks := make(map[string]Task, len(ts))
+	for _, t := range ts {
+		if _, ok := tasks[t.ID]; ok {
+			return fmt.Errorf("%w: %s", ErrConflict, t.ID)
+		}
+		tasks[t.ID] = t
+	}
+	lookup := func(id string) (Task, bool) {
+		t, ok := tasks[id]
+		return t, ok
+	}
+	for _, t := range ts {
+		if err := checkParent(t, lookup); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.tasks = tasks
+	s.mu.Unlock()
+	return s.persist()
+}
+
+func (s *memStore) Count(ctx context.Context, status string, includeArchived bool) (TaskCounts, error) {
+	if err := ctx.Err(); err != nil {
+		return TaskCounts{}, err
+	}
+	c := TaskCounts{ByStatus: make(map[string]int)}
+	if status != "" {
+		c.ByStatus[status] = 0
+	} else {
+		for _, st := range allowedStatuses {
+			c.ByStatus[st] = 0
+		}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, t := range s.tasks {
+		if status != "" && t.Status != status {
+			continue
+		}
+		if t.Archived && !includeArchived {
+			continue
+		}
+		c.Total++
+		c.ByStatus[t.Status]++
+	}
+	return c, nil
+}
+
+func (s *memStore) load() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []Task
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("parse %s: %w", s.path, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range list {
+		s.tasks[t.ID] = t
+	}
+	return nil
+}
+
+func (s *memStore) save() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	s.mu.RLock()
+	list := make([]Task, 0, len(s.tasks))
+	for _, t := range s.tasks {
+		list = append(list, t)
+	}
+	s.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".tasks-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// persist writes the tasks to s.path. Mutations have already been applied in
+// memory when it fails, so callers surface the error rather than report
+// success for data that never reached disk.
+func (s *memStore) persist() error {
+	if s.path == "" {
+		return nil
+	}
+	if err := s.save(); err != nil {
+		return fmt.Errorf("save tasks to %s: %w", s.path, err)
+	}
+	return nil
+}
+
+type taskEvent struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+	Task *Task  `json:"task,omitempty"`
+}
+
+type broker struct {
+	mu     sync.Mutex
+	subs   map[chan taskEvent]struct{}
+	closed bool
+}
+
+func newBroker() *broker {
+	return &broker{subs: make(map[chan taskEvent]struct{})}
+}
+
+func (b *broker) subscribe() chan taskEvent {
+	ch := make(chan taskEvent, 16)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return ch
+	}
+	b.subs[ch] = struct{}{}
+	return ch
+}
+
+func (b *broker) unsubscribe(ch chan taskEvent) {
+	b.mu.Lock()
+	delete(b.subs, ch)
+	b.mu.Unlock()
+}
+
+func (b *broker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subs {
+		close(ch)
+		delete(b.subs, ch)
+	}
+}
+
+// publish delivers ev to every subscriber. A subscriber whose buffer is full
+// is closed and dropped instead of silently missing the event, so its client
+// reconnects and resyncs.
+func (b *broker) publish(ev taskEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			close(ch)
+			delete(b.subs, ch)
+		}
+	}
+}
+
+type notifyingStore struct {
+	TaskStore
+	events *broker
+}
+
+func (s notifyingStore) Create(ctx context.Context, ts ...Task) error {
+	if err := s.TaskStore.Create(ctx, ts...); err != nil {
+		return err
+	}
+	for i := range ts {
+		s.events.publish(taskEvent{Type: "created", ID: ts[i].ID, Task: &ts[i]})
+	}
+	return nil
+}
+
+func (s notifyingStore) Update(ctx context.Context, id string, fn func(*Task) error) (Task, error) {
+	t, err := s.TaskStore.Update(ctx, id, fn)
+	if err != nil {
+		return t, err
+	}
+	s.events.publish(taskEvent{Type: "updated", ID: id, Task: &t})
+	return t, nil
+}
+
+func (s notifyingStore) UpdateMany(ctx context.Context, ids []string, fn func(*Task) error) ([]Task, []string, error) {
+	updated, missing, err := s.TaskStore.UpdateMany(ctx, ids, fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range updated {
+		s.events.publish(taskEvent{Type: "updated", ID: updated[i].ID, Task: &updated[i]})
+	}
+	return updated, missing, nil
+}
+
+func (s notifyingStore) Archive(ctx context.Context, id string) (Task, error) {
+	t, err := s.TaskStore.Archive(ctx, id)
+	if err != nil {
+		return Task{}, err
+	}
+	s.events.publish(taskEvent{Type: "deleted", ID: id, Task: &t})
+	return t, nil
+}
+
+func (s notifyingStore) Clear(ctx context.Context) error {
+	if err := s.TaskStore.Clear(ctx); err != nil {
+		return err
+	}
+	s.events.publish(taskEvent{Type: "cleared"})
+	return nil
+}
+
+func (s notifyingStore) Replace(ctx context.Context, ts []Task) error {
+	if err := s.TaskStore.Replace(ctx, ts); err != nil {
+		return err
+	}
+	s.events.publish(taskEvent{Type: "replaced"})
+	return nil
+}
+
+var allowedStatuses = []string{"todo", "in_progress", "done"}
+
+func validStatus(s string) bool {
+	for _, v := range allowedStatuses {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func statusError() error {
+	return fmt.Errorf("invalid status; allowed values: %s", strings.Join(allowedStatuses, ", "))
+}
+
+func validPriority(p int) bool {
+	return p >= minPriority && p <= maxPriority
+}
+
+func priorityError() error {
+	return fmt.Errorf("invalid priority; must be between %d and %d", minPriority, maxPriority)
+}
+
+func validateTask(t Task) error {
+	if !validStatus(t.Status) {
+		return statusError()
+	}
+	if !validPriority(t.Priority) {
+		return priorityError()
+	}
+	return nil
+}
+
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func prepareNewTask(t *Task) error {
+	if t.ID == "" {
+		t.ID = newUUID()
+	}
+	if err := checkID(t.ID); err != nil {
+		return err
+	}
+	if t.Status == "" {
+		t.Status = "todo"
+	}
+	if err := validateTask(*t); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	t.CreatedAt = now
+	t.UpdatedAt = now
+	t.Version = 1
+	return nil
+}
+
+// precondition is the state a write expects to replace: a version, plus the
+// full ETag when If-Match carried one from GET.
+type precondition struct {
+	version int
+	etag    string
+}
+
+func expectedVersion(r *http.Request, bodyVersion int) (precondition, error) {
+	if h := r.Header.Get("If-Match"); h != "" {
+		tag := strings.Trim(strings.TrimPrefix(strings.TrimSpace(h), "W/"), `"`)
+		prefix, hash, hasHash := strings.Cut(tag, "-")
+		v, err := strconv.Atoi(prefix)
+		if err != nil || hasHash && hash == "" {
+			return precondition{}, errors.New("invalid If-Match header; expected a task version or ETag")
+		}
+		want := precondition{version: v}
+		if hasHash {
+			want.etag = `"` + tag + `"`
+		}
+		return want, nil
+	}
+	if bodyVersion != 0 {
+		return precondition{version: bodyVersion}, nil
+	}
+	return precondition{}, errVersionRequired
+}
+
+func checkVersion(t *Task, want precondition) error {
+	if t.Version != want.version {
+		return fmt.Errorf("%w: current version is %d", ErrVersionMismatch, t.Version)
+	}
+	if want.etag != "" && taskETag(*t) != want.etag {
+		return fmt.Errorf("%w: task content changed", ErrVersionMismatch)
+	}
+	return nil
+}
+
+// versionError reports a missing or malformed version for task id. A task
+// that does not exist is reported as 404 first, so clients learn about the
+// missing task before the precondition.
+func (s *server) versionError(w http.ResponseWriter, r *http.Request, id string, err error) {
+	if _, gerr := s.store.Get(r.Context(), id); gerr != nil {
+		storeError(w, r, gerr)
+		return
+	}
+	if errors.Is(err, errVersionRequired) {
+		writeError(w, http.StatusPreconditionRequired, err.Error())
+		return
+	}
+	writeError(w, http.StatusBadRequest, err.Error())
+}
+
+var taskSorts = map[string]func(a, b Task) bool{
+	"":         func(a, b Task) bool { return a.ID < b.ID },
+	"id":       func(a, b Task) bool { return a.ID < b.ID },
+	"title":    func(a, b Task) bool { return a.Title < b.Title },
+	"status":   func(a, b Task) bool { return a.Status < b.Status },
+	"priority": func(a, b Task) bool { return a.Priority > b.Priority },
+}
+
+func queryInt(r *http.Request, key string, def int) (int, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%s must not be negative", key)
+	}
+	return n, nil
+}
+
+const maxIdempotencyKeys = 10000
+
+type idempotencyEntry struct {
+	ids   []string
+	batch bool
+}
+
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+type idempotencyCache struct {
+	mu       sync.Mutex
+	entries  map[string]idempotencyEntry
+	order    []string
+	inflight map[string]*keyLock
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{
+		entries:  make(map[string]idempotencyEntry),
+		inflight: make(map[string]*keyLock),
+	}
+}
+
+// lock serializes requests that share key without blocking other keys. It
+// returns the matching unlock.
+func (c *idempotencyCache) lock(key string) func() {
+	c.mu.Lock()
+	l, ok := c.inflight[key]
+	if !ok {
+		l = &keyLock{}
+		c.inflight[key] = l
+	}
+	l.refs++
+	c.mu.Unlock()
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		c.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(c.inflight, key)
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *idempotencyCache) get(key string) (idempotencyEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	return entry, ok
+}
+
+func (c *idempotencyCache) forget(key string) {
+	c.mu.Lock()
+	delete(c.entries, key)
+	c.mu.Unlock()
+}
+
+// reset forgets every recorded key, so retries cannot replay tasks that an
+// import replaced.
+func (c *idempotencyCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]idempotencyEntry)
+	c.order = nil
+}
+
+// put records the tasks created for key, evicting the oldest keys once the
+// cache is full.
+func (c *idempotencyCache) put(key string, created []Task, batch bool) {
+	ids := make([]string, len(created))
+	for i, t := range created {
+		ids[i] = t.ID
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		c.order = append(c.order, key)
+	}
+	c.entries[key] = idempotencyEntry{ids: ids, batch: batch}
+	for len(c.order) > maxIdempotencyKeys {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+type server struct {
+	store       TaskStore
+	events      *broker
+	idempotency *idempotencyCache
+	maxBody     int64
+	maxImport   int64
+}
+
+func newServer(store TaskStore, maxBody, maxImport int64) *server {
+	events := newBroker()
+	return &server{
+		store:       notifyingStore{TaskStore: store, events: events},
+		events:      events,
+		idempotency: newIdempotencyCache(),
+		maxBody:     maxBody,
+		maxImport:   maxImport,
+	}
+}
+
+// reservedIDs are the /tasks/ sub-paths with their own handlers; a task using
+// one of them as its ID could never be fetched.
+var reservedIDs = []string{"count", "stream", "ws", "transition", "export", "import"}
+
+// checkID rejects IDs whose /tasks/{id} URL would not reach handleTask.
+// ServeMux redirects "." and ".." path segments, and "/" splits the ID.
+func checkID(id string) error {
+	if strings.Contains(id, "/") {
+		return fmt.Errorf("id %q must not contain '/'", id)
+	}
+	if id == "." || id == ".." {
+		return fmt.Errorf("id %q is not a valid path segment", id)
+	}
+	if slices.Contains(reservedIDs, id) {
+		return fmt.Errorf("id %q is reserved", id)
+	}
+	return nil
+}
+
+func (s *server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tasks", s.handleTasks)
+	mux.HandleFunc("/tasks/", s.handleTask)
+	mux.HandleFunc("/tasks/stream", s.handleStream)
+	mux.HandleFunc("/tasks/ws", s.handleWS)
+	mux.HandleFunc("/tasks/count", s.handleCount)
+	mux.HandleFunc("/tasks/transition", s.handleTransition)
+	mux.HandleFunc("/tasks/export", s.handleExport)
+	mux.HandleFunc("/tasks/import", s.handleImport)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/openapi.json", handleOpenAPI)
+	mux.HandleFunc("/", handleNotFound)
+	return mux
+}
+
+func (s *server) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
+			return nil, false
+		}
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return nil, false
+	}
+	return body, true
+}
+
+type errorResponse struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: msg, Status: status})
+}
+
+func storeStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrConflict), errors.Is(err, ErrVersionMismatch):
+		return http.StatusConflict
+	case errors.Is(err, ErrParent):
+		return http.StatusBadRequest
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func storeError(w http.ResponseWriter, r *http.Request, err error) {
+	status := storeStatus(err)
+	if status == http.StatusInternalServerError {
+		requestLogger(r.Context()).Error("store operation failed", "err", err)
+	}
+	writeError(w, status, err.Error())
+}
+
+func (s *server) handleTasks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		var jsonl bool
+		switch r.URL.Query().Get("format") {
+		case "":
+			jsonl = strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+		case "json":
+		case "jsonl":
+			jsonl = true
+		default:
+			writeError(w, http.StatusBadRequest, "invalid format; allowed values: json, jsonl")
+			return
+		}
+		// JSONL is meant for bulk export, so it streams everything unless the
+		// client asks for a page.
+		def := defaultLimit
+		if jsonl {
+			def = math.MaxInt
+		}
+		limit, err := queryInt(r, "limit", def)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		offset, err := queryInt(r, "offset", 0)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid offset")
+			return
+		}
+		if limit > maxLimit && !jsonl {
+			limit = maxLimit
+		}
+		less, ok := taskSorts[r.URL.Query().Get("sort")]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid sort field")
+			return
+		}
+		status := r.URL.Query().Get("status")
+		q := strings.ToLower(r.URL.Query().Get("q"))
+		tags := r.URL.Query()["tag"]
+		includeArchived := r.URL.Query().Get("includeArchived") == "true"
+		assignee, byAssignee := r.URL.Query().Get("assignee"), r.URL.Query().Has("assignee")
+		if assignee == "me" {
+			writeError(w, http.StatusBadRequest, "assignee=me is not supported; the server has no per-user identity, so pass the assignee name")
+			return
+		}
+		all, err := s.store.List(r.Context())
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		result := make([]Task, 0, len(all))
+		for _, t := range all {
+			if status != "" && t.Status != status {
+				continue
+			}
+			if q != "" && !strings.Contains(strings.ToLower(t.Title), q) {
+				continue
+			}
+			if !hasTags(t, tags) {
+				continue
+			}
+			if t.Archived && !includeArchived {
+				continue
+			}
+			if byAssignee && t.Assignee != assignee {
+				continue
+			}
+			result = append(result, t)
+		}
+		sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+		sort.SliceStable(result, func(i, j int) bool { return less(result[i], result[j]) })
+		w.Header().Set("X-Total-Count", strconv.Itoa(len(result)))
+		if offset > len(result) {
+			offset = len(result)
+		}
+		result = result[offset:]
+		if limit < len(result) {
+			result = result[:limit]
+		}
+		if jsonl {
+			writeJSONL(w, result)
+			return
+		}
+		json.NewEncoder(w).Encode(result)
+	case http.MethodPost:
+		body, ok := s.readBody(w, r)
+		if !ok {
+			return
+		}
+		dryRun := r.URL.Query().Get("dryRun") == "true"
+		key := r.Header.Get("Idempotency-Key")
+		if dryRun {
+			key = ""
+		}
+		if key != "" {
+			defer s.idempotency.lock(key)()
+			if s.replayCreate(w, r, key) {
+				return
+			}
+		}
+		if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+			if created := s.createTasks(w, r, trimmed, dryRun); created != nil && key != "" {
+				s.idempotency.put(key, created, true)
+			}
+			return
+		}
+		var t Task
+		if err := json.Unmarshal(body, &t); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+		if err := prepareNewTask(&t); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if dryRun {
+			if err := s.store.CheckCreate(r.Context(), t); err != nil {
+				storeError(w, r, err)
+				return
+			}
+			json.NewEncoder(w).Encode(t)
+			return
+		}
+		if err := s.store.Create(r.Context(), t); err != nil {
+			storeError(w, r, err)
+			return
+		}
+		if key != "" {
+			s.idempotency.put(key, []Task{t}, false)
+		}
+		w.Header().Set("Location", "/tasks/"+url.PathEscape(t.ID))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(t)
+	case http.MethodDelete:
+		if r.URL.Query().Get("confirm") != "true" {
+			writeError(w, http.StatusBadRequest, "deleting all tasks requires confirm=true")
+			return
+		}
+		if err := s.store.Clear(r.Context()); err != nil {
+			storeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func writeJSONL(w http.ResponseWriter, list []Task) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	for i, t := range list {
+		if err := enc.Encode(t); err != nil {
+			return
+		}
+		if (i+1)%jsonlFlushEvery == 0 {
+			if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				return
+			}
+		}
+	}
+}
+
+func (s *server) createTasks(w http.ResponseWriter, r *http.Request, body []byte, dryRun bool) []Task {
+	var batch []Task
+	if err := json.Unmarshal(body, &batch); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return nil
+	}
+	seen := make(map[string]bool, len(batch))
+	for i := range batch {
+		if err := prepareNewTask(&batch[i]); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("task %d: %v", i, err))
+			return nil
+		}
+		if seen[batch[i].ID] {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("task %d: duplicate id %q in batch", i, batch[i].ID))
+			return nil
+		}
+		seen[batch[i].ID] = true
+	}
+	if dryRun {
+		if err := s.store.CheckCreate(r.Context(), batch...); err != nil {
+			storeError(w, r, err)
+			return nil
+		}
+		json.NewEncoder(w).Encode(batch)
+		return nil
+	}
+	if err := s.store.Create(r.Context(), batch...); err != nil {
+		storeError(w, r, err)
+		return nil
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(batch)
+	return batch
+}
+
+// replayCreate answers a retried POST from the idempotency cache. The caller
+// must hold the lock for key.
+func (s *server) replayCreate(w http.ResponseWriter, r *http.Request, key string) bool {
+	entry, ok := s.idempotency.get(key)
+	if !ok {
+		return false
+	}
+	created := make([]Task, 0, len(entry.ids))
+	for _, id := range entry.ids {
+		t, err := s.store.Get(r.Context(), id)
+		if errors.Is(err, ErrNotFound) {
+			s.idempotency.forget(key)
+			return false
+		}
+		if err != nil {
+			storeError(w, r, err)
+			return true
+		}
+		created = append(created, t)
+	}
+	if entry.batch {
+		json.NewEncoder(w).Encode(created)
+	} else {
+		json.NewEncoder(w).Encode(created[0])
+	}
+	return true
+}
+
+type taskPatch struct {
+	Title    *string   `json:"title"`
+	Status   *string   `json:"status"`
+	Priority *int      `json:"priority"`
+	Tags     *[]string `json:"tags"`
+	ParentID *string   `json:"parent_id"`
+	Assignee *string   `json:"assignee"`
+	Archived *bool     `json:"archived"`
+	Version  int       `json:"version"`
+}
+
+func (p taskPatch) empty() bool {
+	return p.Title == nil && p.Status == nil && p.Priority == nil && p.Tags == nil && p.ParentID == nil && p.Assignee == nil && p.Archived == nil
+}
+
+func (p taskPatch) validate() error {
+	if p.Status != nil && !validStatus(*p.Status) {
+		return statusError()
+	}
+	if p.Priority != nil && !validPriority(*p.Priority) {
+		return priorityError()
+	}
+	return nil
+}
+
+func (p taskPatch) apply(t *Task) {
+	if p.Title != nil {
+		t.Title = *p.Title
+	}
+	if p.Status != nil {
+		t.Status = *p.Status
+	}
+	if p.Priority != nil {
+		t.Priority = *p.Priority
+	}
+	if p.Tags != nil {
+		t.Tags = *p.Tags
+	}
+	if p.ParentID != nil {
+		t.ParentID = *p.ParentID
+	}
+	if p.Assignee != nil {
+		t.Assignee = *p.Assignee
+	}
+	if p.Archived != nil {
+		t.Archived = *p.Archived
+	}
+}
+
+func hasTags(t Task, want []string) bool {
+	for _, w := range want {
+		if !slices.Contains(t.Tags, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// taskETag is "<version>-<content hash>". The hash keeps it unique when a
+// clear or import brings back an earlier version number with other content;
+// the version prefix lets If-Match requests be checked like a version field.
+func taskETag(t Task) string {
+	body, _ := json.Marshal(t)
+	sum := sha256.Sum256(body)
+	return `"` + strconv.Itoa(t.Version) + "-" + hex.EncodeToString(sum[:8]) + `"`
+}
+
+func etagMatches(header, etag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == etag || v == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *server) handleCount(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	c, err := s.store.Count(r.Context(), q.Get("status"), q.Get("includeArchived") == "true")
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(c)
+}
+
+type transitionRequest struct {
+	IDs    []string `json:"ids"`
+	Status string   `json:"status"`
+}
+
+type transitionResponse struct {
+	Updated  []string `json:"updated"`
+	NotFound []string `json:"not_found"`
+}
+
+func (s *server) handleTransition(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	body, ok := s.readBody(w, r)
+	if !ok {
+		return
+	}
+	var req transitionRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if len(req.IDs) == 0 {
+		writeError(w, http.StatusBadRequest, "ids must not be empty")
+		return
+	}
+	if !validStatus(req.Status) {
+		writeError(w, http.StatusBadRequest, statusError().Error())
+		return
+	}
+	now := time.Now().UTC()
+	updated, missing, err := s.store.UpdateMany(r.Context(), req.IDs, func(t *Task) error {
+		t.Status = req.Status
+		t.UpdatedAt = now
+		return nil
+	})
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	resp := transitionResponse{Updated: make([]string, len(updated)), NotFound: missing}
+	for i, t := range updated {
+		resp.Updated[i] = t.ID
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *server) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	all, err := s.store.List(r.Context())
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="tasks.json"`)
+	json.NewEncoder(w).Encode(all)
+}
+
+type importResponse struct {
+	Imported int `json:"imported"`
+}
+
+func (s *server) handleImport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.maxImport))
+	decodeError := func(err error) {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
+			return
+		}
+		writeError(w, http.StatusBadRequest, "invalid json")
+	}
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		decodeError(err)
+		return
+	}
+	now := time.Now().UTC()
+	ts := make([]Task, 0)
+	seen := make(map[string]bool)
+	for i := 0; dec.More(); i++ {
+		var t Task
+		if err := dec.Decode(&t); err != nil {
+			decodeError(err)
+			return
+		}
+		if t.ID == "" {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("task %d: id is required", i))
+			return
+		}
+		if err := checkID(t.ID); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("task %d: %v", i, err))
+			return
+		}
+		if seen[t.ID] {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("task %d: duplicate id %q", i, t.ID))
+			return
+		}
+		seen[t.ID] = true
+		if err := validateTask(t); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("task %d: %v", i, err))
+			return
+		}
+		if t.Version < 1 {
+			t.Version = 1
+		}
+		if t.CreatedAt.IsZero() {
+			t.CreatedAt = now
+		}
+		if t.UpdatedAt.IsZero() {
+			t.UpdatedAt = t.CreatedAt
+		}
+		ts = append(ts, t)
+	}
+	if _, err := dec.Token(); err != nil {
+		decodeError(err)
+		return
+	}
+	if err := s.store.Replace(r.Context(), ts); err != nil {
+		storeError(w, r, err)
+		return
+	}
+	s.idempotency.reset()
+	json.NewEncoder(w).Encode(importResponse{Imported: len(ts)})
+}
+
+func (s *server) handleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				requestLogger(r.Context()).Error("encode event", "type", ev.Type, "err", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
 )
 
-func handleTasks(w http.ResponseWriter, r *http.Request) {
+const (
+	wsCloseNormal      = 1000
+	wsCloseGoingAway   = 1001
+	wsCloseProtocol    = 1002
+	wsCloseUnsupported = 1003
+	wsCloseTooLarge    = 1009
+)
+
+const wsWriteTimeout = 10 * time.Second
+
+var (
+	errWSClosed      = errors.New("websocket closed")
+	errWSProtocol    = errors.New("websocket protocol error")
+	errWSUnsupported = errors.New("websocket binary frames unsupported")
+	errWSTooLarge    = errors.New("websocket message too large")
+)
+
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	mu   sync.Mutex
+}
+
+func (c *wsConn) write(op byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hdr := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		hdr = append(hdr, byte(n))
+	case n <= math.MaxUint16:
+		hdr = append(hdr, 126)
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr = append(hdr, 127)
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := c.rw.Write(hdr); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(payload); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+func (c *wsConn) writeJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.write(wsText, data)
+}
+
+func (c *wsConn) close(code int) error {
+	return c.write(wsClose, binary.BigEndian.AppendUint16(nil, uint16(code)))
+}
+
+func (c *wsConn) readFrame(max int64) (fin bool, op byte, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(c.rw, hdr[:]); err != nil {
+		return
+	}
+	fin, op = hdr[0]&0x80 != 0, hdr[0]&0x0f
+	if hdr[0]&0x70 != 0 || hdr[1]&0x80 == 0 {
+		return fin, op, nil, errWSProtocol
+	}
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.rw, ext[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.rw, ext[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > uint64(max) {
+		return fin, op, nil, errWSTooLarge
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.rw, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.rw, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// readMessage returns the next complete text message, answering pings and
+// close frames along the way.
+func (c *wsConn) readMessage(max int64) ([]byte, error) {
+	var msg []byte
+	started := false
+	for {
+		fin, op, payload, err := c.readFrame(max)
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case wsPing:
+			if err := c.write(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			code := wsCloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.close(code)
+			return nil, errWSClosed
+		case wsBinary:
+			return nil, errWSUnsupported
+		case wsText:
+			if started {
+				return nil, errWSProtocol
+			}
+			started = true
+		case wsContinuation:
+			if !started {
+				return nil, errWSProtocol
+			}
+		default:
+			return nil, errWSProtocol
+		}
+		if int64(len(msg)+len(payload)) > max {
+			return nil, errWSTooLarge
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+type wsRequest struct {
+	Type  string    `json:"type"`
+	ID    string    `json:"id"`
+	Task  Task      `json:"task"`
+	Patch taskPatch `json:"patch"`
+}
+
+type wsError struct {
+	Type string `json:"type"`
+	errorResponse
+}
+
+func (s *server) handleWS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		writeError(w, http.StatusBadRequest, "websocket upgrade required")
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, http.StatusUpgradeRequired, "unsupported websocket version")
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		writeError(w, http.StatusBadRequest, "missing Sec-WebSocket-Key")
+		return
+	}
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "websocket unsupported")
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", wsAccept(key))
+	if err := rw.Flush(); err != nil {
+		return
+	}
+	ws := &wsConn{conn: conn, rw: rw}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.readWS(r.Context(), ws)
+	}()
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-r.Context().Done():
+			ws.close(wsCloseGoingAway)
+			return
+		case <-keepAlive.C:
+			if err := ws.write(wsPing, nil); err != nil {
+				return
+			}
+		case ev, ok := <-ch:
+			if !ok {
+				ws.close(wsCloseGoingAway)
+				return
+			}
+			if err := ws.writeJSON(ev); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readWS applies incoming create and update requests until the socket closes.
+// Failures are reported back on the socket; successes arrive through the
+// regular event stream.
+func (s *server) readWS(ctx context.Context, ws *wsConn) {
+	for {
+		msg, err := ws.readMessage(s.maxBody)
+		switch {
+		case errors.Is(err, errWSProtocol):
+			ws.close(wsCloseProtocol)
+			return
+		case errors.Is(err, errWSUnsupported):
+			ws.close(wsCloseUnsupported)
+			return
+		case errors.Is(err, errWSTooLarge):
+			ws.close(wsCloseTooLarge)
+			return
+		case err != nil:
+			return
+		}
+		if status, err := s.applyWS(ctx, msg); err != nil {
+			if status == http.StatusInternalServerError {
+				requestLogger(ctx).Error("store operation failed", "err", err)
+			}
+			if err := ws.writeJSON(wsError{"error", errorResponse{Error: err.Error(), Status: status}}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *server) applyWS(ctx context.Context, msg []byte) (int, error) {
+	var req wsRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		return http.StatusBadRequest, errors.New("invalid json")
+	}
+	switch req.Type {
+	case "create":
+		if err := prepareNewTask(&req.Task); err != nil {
+			return http.StatusBadRequest, err
+		}
+		if err := s.store.Create(ctx, req.Task); err != nil {
+			return storeStatus(err), err
+		}
+	case "update":
+		if err := req.Patch.validate(); err != nil {
+			return http.StatusBadRequest, err
+		}
+		if req.Patch.Version == 0 {
+			return http.StatusPreconditionRequired, errors.New("version field required")
+		}
+		_, err := s.store.Update(ctx, req.ID, func(t *Task) error {
+			if err := checkVersion(t, precondition{version: req.Patch.Version}); err != nil {
+				return err
+			}
+			req.Patch.apply(t)
+			t.UpdatedAt = time.Now().UTC()
+			return nil
+		})
+		if err != nil {
+			return storeStatus(err), err
+		}
+	default:
+		return http.StatusBadRequest, fmt.Errorf("unknown message type %q", req.Type)
+	}
+	return 0, nil
+}
+
+func (s *server) handleChildren(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if _, err := s.store.Get(r.Context(), id); err != nil {
+		storeError(w, r, err)
+		return
+	}
+	all, err := s.store.List(r.Context())
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	includeArchived := r.URL.Query().Get("includeArchived") == "true"
+	children := make([]Task, 0)
+	for _, t := range all {
+		if t.ParentID != id || t.Archived && !includeArchived {
+			continue
+		}
+		children = append(children, t)
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].ID < children[j].ID })
+	json.NewEncoder(w).Encode(children)
+}
+
+func (s *server) handleTask(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/tasks/"), "/")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "missing task id")
+		return
+	}
+	switch sub {
+	case "":
+	case "children":
+		s.handleChildren(w, r, id)
+		return
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
 	switch r.Method {
 	case http.MethodGet:
-		mu.RLock()
-		defer mu.RUnlock()
-		result := make([]Task, 0, len(tasks))
-		for _, t := range tasks {
-			result = append(result, t)
+		t, err := s.store.Get(r.Context(), id)
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		body, err := json.Marshal(t)
+		if err != nil {
+			requestLogger(r.Context()).Error("encode task", "id", id, "err", err)
+			writeError(w, http.StatusInternalServerError, "encode task")
+			return
+		}
+		etag := taskETag(t)
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write(append(body, '\n'))
+	case http.MethodDelete:
+		if _, err := s.store.Archive(r.Context(), id); err != nil {
+			storeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPut:
+		body, ok := s.readBody(w, r)
+		if !ok {
+			return
 		}
-		json.NewEncoder(w).Encode(result)
-	case http.MethodPost:
 		var t Task
-		json.NewDecoder(r.Body).Decode(&t)
-		mu.Lock()
-		tasks[t.ID] = t
-		mu.Unlock()
-		w.WriteHeader(http.StatusCreated)
+		if err := json.Unmarshal(body, &t); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+		t.ID = id
+		if err := validateTask(t); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		want, err := expectedVersion(r, t.Version)
+		if err != nil {
+			s.versionError(w, r, id, err)
+			return
+		}
+		updated, err := s.store.Update(r.Context(), id, func(old *Task) error {
+			if err := checkVersion(old, want); err != nil {
+				return err
+			}
+			t.CreatedAt = old.CreatedAt
+			t.UpdatedAt = time.Now().UTC()
+			*old = t
+			return nil
+		})
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(updated)
+	case http.MethodPatch:
+		body, ok := s.readBody(w, r)
+		if !ok {
+			return
+		}
+		var p taskPatch
+		if len(bytes.TrimSpace(body)) > 0 {
+			if err := json.Unmarshal(body, &p); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid json")
+				return
+			}
+		}
+		if err := p.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var (
+			t   Task
+			err error
+		)
+		if p.empty() {
+			t, err = s.store.Get(r.Context(), id)
+		} else {
+			want, verr := expectedVersion(r, p.Version)
+			if verr != nil {
+				s.versionError(w, r, id, verr)
+				return
+			}
+			t, err = s.store.Update(r.Context(), id, func(t *Task) error {
+				if err := checkVersion(t, want); err != nil {
+					return err
+				}
+				p.apply(t)
+				t.UpdatedAt = time.Now().UTC()
+				return nil
+			})
+		}
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
 		json.NewEncoder(w).Encode(t)
+	default:
+		w.Header().Set("Allow", "GET, PUT, PATCH, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+type requestIDKey struct{}
+
+const maxRequestIDLen = 128
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newUUID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func requestLogger(ctx context.Context) *slog.Logger {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		requestLogger(r.Context()).Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"remote_addr", r.RemoteAddr,
+		)
+	})
+}
+
+var durationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type requestKey struct {
+	method string
+	status int
+}
+
+type metrics struct {
+	mu       sync.Mutex
+	requests map[requestKey]uint64
+	buckets  []uint64
+	count    uint64
+	sum      float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: make(map[requestKey]uint64),
+		buckets:  make([]uint64, len(durationBuckets)),
+	}
+}
+
+// metricMethod folds methods outside the standard set into one label so
+// arbitrary client tokens cannot grow the requests map.
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+// untimedPaths are left out of the latency histogram: the streams stay open
+// for the life of the client and would drown the handler percentiles.
+var untimedPaths = map[string]bool{"/tasks/stream": true, "/tasks/ws": true, "/metrics": true}
+
+func (m *metrics) observe(method, path string, status int, d time.Duration) {
+	method = metricMethod(method)
+	secs := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{method, status}]++
+	if untimedPaths[path] {
+		return
+	}
+	for i, le := range durationBuckets {
+		if secs <= le {
+			m.buckets[i]++
+		}
+	}
+	m.count++
+	m.sum += secs
+}
+
+func (m *metrics) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		m.observe(r.Method, r.URL.Path, rec.status, time.Since(start))
+	})
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+	var b strings.Builder
+	b.WriteString("# HELP http_requests_total Total HTTP requests by method and status.\n")
+	b.WriteString("# TYPE http_requests_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "http_requests_total{method=%q,status=\"%d\"} %d\n", k.method, k.status, m.requests[k])
+	}
+	b.WriteString("# HELP http_request_duration_seconds HTTP request latency in seconds, excluding streaming endpoints.\n")
+	b.WriteString("# TYPE http_request_duration_seconds histogram\n")
+	for i, le := range durationBuckets {
+		fmt.Fprintf(&b, "http_request_duration_seconds_bucket{le=\"%g\"} %d\n", le, m.buckets[i])
+	}
+	fmt.Fprintf(&b, "http_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.count)
+	fmt.Fprintf(&b, "http_request_duration_seconds_sum %g\n", m.sum)
+	fmt.Fprintf(&b, "http_request_duration_seconds_count %d\n", m.count)
+	m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	io.WriteString(w, b.String())
+}
+
+const gzipMinSize = 1024
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	buf         []byte
+	gz          *gzip.Writer
+	passthrough bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	g.status = code
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	switch {
+	case g.gz != nil:
+		return g.gz.Write(p)
+	case g.passthrough:
+		return g.ResponseWriter.Write(p)
+	}
+	g.buf = append(g.buf, p...)
+	if len(g.buf) >= gzipMinSize {
+		if err := g.start(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (g *gzipResponseWriter) start() error {
+	h := g.ResponseWriter.Header()
+	if g.status == http.StatusNotModified || g.status == http.StatusNoContent || h.Get("Content-Encoding") != "" {
+		g.passthrough = true
+		g.ResponseWriter.WriteHeader(g.status)
+		_, err := g.ResponseWriter.Write(g.buf)
+		g.buf = nil
+		return err
+	}
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	g.ResponseWriter.WriteHeader(g.status)
+	g.gz = gzip.NewWriter(g.ResponseWriter)
+	_, err := g.gz.Write(g.buf)
+	g.buf = nil
+	return err
+}
+
+func (g *gzipResponseWriter) Flush() {
+	if g.gz == nil && !g.passthrough {
+		if err := g.start(); err != nil {
+			return
+		}
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+func (g *gzipResponseWriter) close() error {
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	if g.passthrough {
+		return nil
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	if len(g.buf) == 0 {
+		return nil
+	}
+	_, err := g.ResponseWriter.Write(g.buf)
+	return err
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.TrimSpace(name) == "gzip" && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+func withGzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(gw, r)
+		if err := gw.close(); err != nil {
+			requestLogger(r.Context()).Error("gzip response", "path", r.URL.Path, "err", err)
+		}
+	})
+}
+
+func withCORS(origin string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		h.Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-Match, If-None-Match, Idempotency-Key, X-Request-ID")
+		h.Set("Access-Control-Expose-Headers", "ETag, Location, X-Request-ID, X-Total-Count")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+const limiterIdleTTL = 3 * time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	proxyHops int
+	buckets   map[string]*bucket
+}
+
+// newRateLimiter keys clients on RemoteAddr, or with proxyHops > 0 on the
+// X-Forwarded-For entry appended by the outermost of that many trusted
+// proxies.
+func newRateLimiter(rate float64, burst, proxyHops int) *rateLimiter {
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		proxyHops: proxyHops,
+		buckets:   make(map[string]*bucket),
+	}
+}
+
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+func (l *rateLimiter) evictIdle(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > limiterIdleTTL {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *rateLimiter) janitor() {
+	for now := range time.Tick(time.Minute) {
+		l.evictIdle(now)
+	}
+}
+
+func (l *rateLimiter) clientIP(r *http.Request) string {
+	if l.proxyHops > 0 {
+		// Entries left of the ones our proxies appended are client-supplied.
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		if n := len(hops) - l.proxyHops; n >= 0 {
+			if ip := strings.TrimSpace(hops[n]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (l *rateLimiter) limit(next http.Handler) http.Handler {
+	if l.rate <= 0 {
+		return next
+	}
+	go l.janitor()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok, wait := l.allow(l.clientIP(r), time.Now())
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "Tasks API",
+    "version": "1.0.0"
+  },
+  "components": {
+    "securitySchemes": {
+      "bearerAuth": {
+        "type": "http",
+        "scheme": "bearer"
+      }
+    },
+    "parameters": {
+      "TaskID": {
+        "name": "id",
+        "in": "path",
+        "required": true,
+        "schema": {
+          "type": "string"
+        }
+      },
+      "IfMatch": {
+        "name": "If-Match",
+        "in": "header",
+        "description": "Expected current task version, or the ETag from GET (which also checks the content); alternative to the version body field",
+        "schema": {
+          "type": "string"
+        }
+      }
+    },
+    "schemas": {
+      "Task": {
+        "type": "object",
+        "properties": {
+          "id": {
+            "type": "string",
+            "description": "Generated by the server when omitted on create"
+          },
+          "title": {
+            "type": "string"
+          },
+          "status": {
+            "type": "string",
+            "enum": [
+              "todo",
+              "in_progress",
+              "done"
+            ],
+            "default": "todo"
+          },
+          "priority": {
+            "type": "integer",
+            "minimum": 0,
+            "maximum": 5
+          },
+          "tags": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            }
+          },
+          "created_at": {
+            "type": "string",
+            "format": "date-time",
+            "readOnly": true
+          },
+          "updated_at": {
+            "type": "string",
+            "format": "date-time",
+            "readOnly": true
+          },
+          "version": {
+            "type": "integer",
+            "description": "Incremented on every modification; send it back (or in If-Match) to update"
+          },
+          "parent_id": {
+            "type": "string",
+            "description": "ID of an existing parent task; empty for top-level tasks"
+          },
+          "archived": {
+            "type": "boolean",
+            "description": "Set by DELETE; archived tasks are hidden from listings unless includeArchived=true"
+          },
+          "assignee": {
+            "type": "string"
+          }
+        }
+      },
+      "TaskPatch": {
+        "type": "object",
+        "properties": {
+          "title": {
+            "type": "string"
+          },
+          "status": {
+            "type": "string",
+            "enum": [
+              "todo",
+              "in_progress",
+              "done"
+            ]
+          },
+          "priority": {
+            "type": "integer",
+            "minimum": 0,
+            "maximum": 5
+          },
+          "tags": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            }
+          },
+          "version": {
+            "type": "integer"
+          },
+          "parent_id": {
+            "type": "string"
+          },
+          "archived": {
+            "type": "boolean",
+            "description": "Set to false to restore an archived task"
+          },
+          "assignee": {
+            "type": "string"
+          }
+        }
+      },
+      "Error": {
+        "type": "object",
+        "required": [
+          "error",
+          "status"
+        ],
+        "properties": {
+          "error": {
+            "type": "string"
+          },
+          "status": {
+            "type": "integer"
+          }
+        }
+      },
+      "TaskCounts": {
+        "type": "object",
+        "properties": {
+          "total": {
+            "type": "integer"
+          },
+          "by_status": {
+            "type": "object",
+            "additionalProperties": {
+              "type": "integer"
+            }
+          }
+        }
+      },
+      "TransitionRequest": {
+        "type": "object",
+        "required": [
+          "ids",
+          "status"
+        ],
+        "properties": {
+          "ids": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            }
+          },
+          "status": {
+            "type": "string",
+            "enum": [
+              "todo",
+              "in_progress",
+              "done"
+            ]
+          }
+        }
+      },
+      "TransitionResult": {
+        "type": "object",
+        "properties": {
+          "updated": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            }
+          },
+          "not_found": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            }
+          }
+        }
+      },
+      "ImportResult": {
+        "type": "object",
+        "required": [
+          "imported"
+        ],
+        "properties": {
+          "imported": {
+            "type": "integer"
+          }
+        }
+      }
+    },
+    "responses": {
+      "Error": {
+        "description": "Error",
+        "content": {
+          "application/json": {
+            "schema": {
+              "$ref": "#/components/schemas/Error"
+            }
+          }
+        }
+      }
+    }
+  },
+  "security": [
+    {},
+    {
+      "bearerAuth": []
+    }
+  ],
+  "paths": {
+    "/tasks": {
+      "get": {
+        "summary": "List tasks",
+        "parameters": [
+          {
+            "name": "limit",
+            "in": "query",
+            "schema": {
+              "type": "integer",
+              "minimum": 0
+            },
+            "description": "Page size for JSON responses (default 100, capped at 1000); unlimited by default with format=jsonl"
+          },
+          {
+            "name": "offset",
+            "in": "query",
+            "schema": {
+              "type": "integer",
+              "minimum": 0,
+              "default": 0
+            }
+          },
+          {
+            "name": "sort",
+            "in": "query",
+            "schema": {
+              "type": "string",
+              "enum": [
+                "id",
+                "title",
+                "status",
+                "priority"
+              ],
+              "default": "id"
+            }
+          },
+          {
+            "name": "status",
+            "in": "query",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "q",
+            "in": "query",
+            "description": "Case-insensitive title substring",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "tag",
+            "in": "query",
+            "description": "Require this tag; repeat to require several",
+            "schema": {
+              "type": "array",
+              "items": {
+                "type": "string"
+              }
+            },
+            "style": "form",
+            "explode": true
+          },
+          {
+            "name": "format",
+            "in": "query",
+            "description": "jsonl streams one task per line; also selected by Accept: application/x-ndjson. In jsonl mode every match is returned unless limit is given, and limit is not capped.",
+            "schema": {
+              "type": "string",
+              "enum": [
+                "json",
+                "jsonl"
+              ],
+              "default": "json"
+            }
+          },
+          {
+            "name": "includeArchived",
+            "in": "query",
+            "schema": {
+              "type": "boolean",
+              "default": false
+            }
+          },
+          {
+            "name": "assignee",
+            "in": "query",
+            "description": "Exact assignee match; an empty value selects unassigned tasks. \"me\" is rejected with 400 because requests carry no per-user identity.",
+            "schema": {
+              "type": "string"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Tasks",
+            "headers": {
+              "X-Total-Count": {
+                "schema": {
+                  "type": "integer"
+                }
+              }
+            },
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "array",
+                  "items": {
+                    "$ref": "#/components/schemas/Task"
+                  }
+                }
+              },
+              "application/x-ndjson": {
+                "schema": {
+                  "type": "string"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/Error"
+          }
+        }
+      },
+      "post": {
+        "summary": "Create one task or a batch of tasks",
+        "parameters": [
+          {
+            "name": "Idempotency-Key",
+            "in": "header",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "dryRun",
+            "in": "query",
+            "description": "Validate without creating; responds 200 with the would-be-created tasks",
+            "schema": {
+              "type": "boolean",
+              "default": false
+            }
+          }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "oneOf": [
+                  {
+                    "$ref": "#/components/schemas/Task"
+                  },
+                  {
+                    "type": "array",
+                    "items": {
+                      "$ref": "#/components/schemas/Task"
+                    }
+                  }
+                ]
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "Dry-run result, or replayed result for a previously seen Idempotency-Key",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "oneOf": [
+                    {
+                      "$ref": "#/components/schemas/Task"
+                    },
+                    {
+                      "type": "array",
+                      "items": {
+                        "$ref": "#/components/schemas/Task"
+                      }
+                    }
+                  ]
+                }
+              }
+            }
+          },
+          "201": {
+            "description": "Created",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "oneOf": [
+                    {
+                      "$ref": "#/components/schemas/Task"
+                    },
+                    {
+                      "type": "array",
+                      "items": {
+                        "$ref": "#/components/schemas/Task"
+                      }
+                    }
+                  ]
+                }
+              }
+            },
+            "headers": {
+              "Location": {
+                "description": "URL of the created task (single-task requests only)",
+                "schema": {
+                  "type": "string"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/Error"
+          },
+          "413": {
+            "$ref": "#/components/responses/Error"
+          },
+          "409": {
+            "$ref": "#/components/responses/Error"
+          }
+        }
+      },
+      "delete": {
+        "summary": "Delete all tasks",
+        "parameters": [
+          {
+            "name": "confirm",
+            "in": "query",
+            "required": true,
+            "schema": {
+              "type": "string",
+              "enum": [
+                "true"
+              ]
+            }
+          }
+        ],
+        "responses": {
+          "204": {
+            "description": "Deleted"
+          },
+          "400": {
+            "$ref": "#/components/responses/Error"
+          }
+        }
+      }
+    },
+    "/tasks/{id}": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/TaskID"
+        }
+      ],
+      "get": {
+        "summary": "Get a task",
+        "parameters": [
+          {
+            "name": "If-None-Match",
+            "in": "header",
+            "schema": {
+              "type": "string"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Task",
+            "headers": {
+              "ETag": {
+                "schema": {
+                  "type": "string"
+                },
+                "description": "\"<version>-<content hash>\"; usable as If-Match and If-None-Match"
+              }
+            },
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Task"
+                }
+              }
+            }
+          },
+          "304": {
+            "description": "Not modified"
+          },
+          "404": {
+            "$ref": "#/components/responses/Error"
+          }
+        }
+      },
+      "put": {
+        "summary": "Replace a task",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/Task"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "Updated",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Task"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/Error"
+          },
+          "404": {
+            "$ref": "#/components/responses/Error"
+          },
+          "409": {
+            "$ref": "#/components/responses/Error"
+          },
+          "428": {
+            "$ref": "#/components/responses/Error"
+          }
+        },
+        "parameters": [
+          {
+            "$ref": "#/components/parameters/IfMatch"
+          }
+        ]
+      },
+      "patch": {
+        "summary": "Update selected fields of a task",
+        "requestBody": {
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/TaskPatch"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "Updated",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Task"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/Error"
+          },
+          "404": {
+            "$ref": "#/components/responses/Error"
+          },
+          "409": {
+            "$ref": "#/components/responses/Error"
+          },
+          "428": {
+            "$ref": "#/components/responses/Error"
+          }
+        },
+        "parameters": [
+          {
+            "$ref": "#/components/parameters/IfMatch"
+          }
+        ]
+      },
+      "delete": {
+        "summary": "Archive a task",
+        "responses": {
+          "204": {
+            "description": "Deleted"
+          },
+          "404": {
+            "$ref": "#/components/responses/Error"
+          }
+        },
+        "description": "Sets archived=true and publishes a deleted event; PATCH archived=false restores the task."
+      }
+    },
+    "/tasks/{id}/children": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/TaskID"
+        }
+      ],
+      "get": {
+        "summary": "List direct children of a task",
+        "responses": {
+          "200": {
+            "description": "Child tasks",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "array",
+                  "items": {
+                    "$ref": "#/components/schemas/Task"
+                  }
+                }
+              }
+            }
+          },
+          "404": {
+            "$ref": "#/components/responses/Error"
+          }
+        },
+        "parameters": [
+          {
+            "name": "includeArchived",
+            "in": "query",
+            "schema": {
+              "type": "boolean",
+              "default": false
+            }
+          }
+        ]
+      }
+    },
+    "/tasks/count": {
+      "get": {
+        "summary": "Count tasks by status",
+        "parameters": [
+          {
+            "name": "status",
+            "in": "query",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "includeArchived",
+            "in": "query",
+            "schema": {
+              "type": "boolean",
+              "default": false
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Counts",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/TaskCounts"
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "/tasks/transition": {
+      "post": {
+        "summary": "Set the status of many tasks at once",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/TransitionRequest"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "IDs updated and IDs not found",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/TransitionResult"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/Error"
+          }
+        }
+      }
+    },
+    "/tasks/export": {
+      "get": {
+        "summary": "Export every task, including archived ones, as a JSON array",
+        "responses": {
+          "200": {
+            "description": "All tasks sorted by id",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "array",
+                  "items": {
+                    "$ref": "#/components/schemas/Task"
+                  }
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "/tasks/import": {
+      "post": {
+        "summary": "Replace the entire task set with an exported array",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "type": "array",
+                "items": {
+                  "$ref": "#/components/schemas/Task"
+                }
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "Tasks imported",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/ImportResult"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/Error"
+          },
+          "409": {
+            "$ref": "#/components/responses/Error"
+          },
+          "413": {
+            "$ref": "#/components/responses/Error"
+          }
+        },
+        "description": "The body is limited by -max-import (64 MiB by default) rather than -max-body. A successful import also clears the Idempotency-Key cache."
+      }
+    },
+    "/tasks/stream": {
+      "get": {
+        "summary": "Stream task changes as server-sent events",
+        "responses": {
+          "200": {
+            "description": "Event stream",
+            "content": {
+              "text/event-stream": {
+                "schema": {
+                  "type": "string"
+                }
+              }
+            }
+          }
+        },
+        "description": "Event types are created, updated, deleted, cleared and replaced. DELETE archives rather than removes, so deleted events carry the archived task alongside its id. A client that falls too far behind is disconnected and should reconnect and re-fetch /tasks."
+      }
+    },
+    "/tasks/ws": {
+      "get": {
+        "summary": "Stream task changes over a WebSocket",
+        "description": "Pushes the same events as /tasks/stream as JSON text frames. Clients may send {\"type\":\"create\",\"task\":{...}} or {\"type\":\"update\",\"id\":\"...\",\"patch\":{...,\"version\":N}}; failures are answered with {\"type\":\"error\",\"error\":\"...\",\"status\":N}.",
+        "responses": {
+          "101": {
+            "description": "Switched to the WebSocket protocol"
+          },
+          "400": {
+            "$ref": "#/components/responses/Error"
+          },
+          "426": {
+            "$ref": "#/components/responses/Error"
+          }
+        }
+      }
+    },
+    "/healthz": {
+      "get": {
+        "summary": "Liveness probe",
+        "security": [],
+        "responses": {
+          "200": {
+            "description": "OK",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "status": {
+                      "type": "string"
+                    }
+                  }
+                }
+              }
+            }
+          }
+        }
+      }
+    }
+  }
+}
+`
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, openAPISpec)
+}
+
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, "not found")
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}` + "\n"))
+}
+
+// duration is a time.Duration that reads from JSON strings such as "15s".
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var v string
+	if err := json.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("duration must be a string such as \"15s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// config holds every server option. Values come from defaultConfig, then an
+// optional -config file, then command-line flags.
+type config struct {
+	Addr         string   `json:"addr"`          // listen address; ADDR env var by default
+	TasksFile    string   `json:"tasks_file"`    // persistence file; TASKS_FILE env var by default
+	MaxBody      int64    `json:"max_body"`      // request body limit in bytes
+	MaxImport    int64    `json:"max_import"`    // POST /tasks/import body limit in bytes
+	ReadTimeout  duration `json:"read_timeout"`  // e.g. "15s"
+	WriteTimeout duration `json:"write_timeout"` // e.g. "15s"
+	IdleTimeout  duration `json:"idle_timeout"`  // e.g. "60s"
+	Rate         float64  `json:"rate"`          // per-client requests per second; 0 disables limiting
+	Burst        int      `json:"burst"`         // per-client burst size
+	TrustProxy   bool     `json:"trust_proxy"`   // key rate limits on X-Forwarded-For
+	ProxyHops    int      `json:"proxy_hops"`    // trusted proxies in front of the server
+	Token        string   `json:"token"`         // bearer token; empty disables auth
+	CORSOrigin   string   `json:"cors_origin"`   // Access-Control-Allow-Origin value
+	LogLevel     string   `json:"log_level"`     // debug, info, warn or error
+}
+
+func defaultConfig() config {
+	return config{
+		Addr:         envOr("ADDR", ":8080"),
+		TasksFile:    envOr("TASKS_FILE", "tasks.json"),
+		MaxBody:      1 << 20,
+		MaxImport:    64 << 20,
+		ReadTimeout:  duration{15 * time.Second},
+		WriteTimeout: duration{15 * time.Second},
+		IdleTimeout:  duration{60 * time.Second},
+		Burst:        20,
+		ProxyHops:    1,
+		CORSOrigin:   "*",
+		LogLevel:     "info",
+	}
+}
+
+func (c *config) load(path string) error {
+	if ext := filepath.Ext(path); ext != ".json" {
+		return fmt.Errorf("config %s: unsupported format %q; only JSON is supported", path, ext)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+	return nil
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// parseConfig registers the server flags on fs and parses args. Values from
+// the -config file replace the defaults, and flags set explicitly in args are
+// re-applied on top of the file.
+func parseConfig(fs *flag.FlagSet, args []string) (config, error) {
+	cfg := defaultConfig()
+	configPath := fs.String("config", "", "path to a JSON config file; flags override its values")
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "listen address")
+	fs.StringVar(&cfg.TasksFile, "tasks-file", cfg.TasksFile, "file used to persist tasks (empty disables persistence)")
+	fs.Int64Var(&cfg.MaxBody, "max-body", cfg.MaxBody, "maximum request body size in bytes")
+	fs.Int64Var(&cfg.MaxImport, "max-import", cfg.MaxImport, "maximum /tasks/import body size in bytes")
+	fs.DurationVar(&cfg.ReadTimeout.Duration, "read-timeout", cfg.ReadTimeout.Duration, "maximum duration for reading a request")
+	fs.DurationVar(&cfg.WriteTimeout.Duration, "write-timeout", cfg.WriteTimeout.Duration, "maximum duration for writing a response")
+	fs.DurationVar(&cfg.IdleTimeout.Duration, "idle-timeout", cfg.IdleTimeout.Duration, "maximum keep-alive idle time")
+	fs.Float64Var(&cfg.Rate, "rate", cfg.Rate, "per-client request rate limit in requests per second (0 disables)")
+	fs.IntVar(&cfg.Burst, "burst", cfg.Burst, "per-client burst size for the rate limiter")
+	fs.BoolVar(&cfg.TrustProxy, "trust-proxy", cfg.TrustProxy, "use X-Forwarded-For to identify clients for rate limiting")
+	fs.IntVar(&cfg.ProxyHops, "proxy-hops", cfg.ProxyHops, "number of trusted proxies appending to X-Forwarded-For (with -trust-proxy)")
+	fs.StringVar(&cfg.Token, "token", cfg.Token, "require this bearer token on every request except /healthz")
+	fs.StringVar(&cfg.CORSOrigin, "cors-origin", cfg.CORSOrigin, "value for Access-Control-Allow-Origin")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "minimum log level: debug, info, warn or error")
+	if err := fs.Parse(args); err != nil {
+		return config{}, err
+	}
+	if *configPath != "" {
+		set := make(map[string]string)
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = f.Value.String() })
+		if err := cfg.load(*configPath); err != nil {
+			return config{}, err
+		}
+		for name, v := range set {
+			if err := fs.Set(name, v); err != nil {
+				return config{}, err
+			}
+		}
+	}
+	if cfg.Rate > 0 && cfg.Burst < 1 {
+		return config{}, errors.New("burst must be at least 1 when rate is set")
 	}
+	if cfg.TrustProxy && cfg.ProxyHops < 1 {
+		return config{}, errors.New("proxy-hops must be at least 1 with -trust-proxy")
+	}
+	return cfg, nil
 }
 
 func main() {
-	http.HandleFunc("/tasks", handleTasks)
-	fmt.Println("Server starting on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	cfg, err := parseConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid log level %q\n", cfg.LogLevel)
+		os.Exit(2)
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	store := newMemStore(cfg.TasksFile)
+	if err := store.load(); err != nil {
+		fatal("load tasks", err)
+	}
+	s := newServer(store, cfg.MaxBody, cfg.MaxImport)
+	mux := s.routes()
+	m := newMetrics()
+	mux.Handle("/metrics", m)
+
+	proxyHops := 0
+	if cfg.TrustProxy {
+		proxyHops = cfg.ProxyHops
+	}
+	limiter := newRateLimiter(cfg.Rate, cfg.Burst, proxyHops)
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		fatal("listen", err)
+	}
+	httpServer := &http.Server{
+		Handler:      m.instrument(withRequestID(logRequests(withCORS(cfg.CORSOrigin, limiter.limit(requireToken(cfg.Token, withGzip(mux))))))),
+		ReadTimeout:  cfg.ReadTimeout.Duration,
+		WriteTimeout: cfg.WriteTimeout.Duration,
+		IdleTimeout:  cfg.IdleTimeout.Duration,
+	}
+	httpServer.RegisterOnShutdown(s.events.close)
+	go func() {
+		slog.Info("server starting", "addr", ln.Addr().String())
+		if err := httpServer.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("serve", err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	slog.Info("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		slog.Error("shutdown", "err", err)
+	}
+	if err := store.persist(); err != nil {
+		slog.Error("save tasks", "err", err)
+	}
 }
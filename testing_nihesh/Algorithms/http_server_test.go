@@ -0,0 +1,1203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHandler(t *testing.T, seed ...Task) http.Handler {
+	t.Helper()
+	store := newMemStore("")
+	if len(seed) > 0 {
+		if err := store.Create(context.Background(), seed...); err != nil {
+			t.Fatalf("seed store: %v", err)
+		}
+	}
+	return newServer(store, 1<<20, 64<<20).routes()
+}
+
+func do(h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestMemStoreCRUD(t *testing.T) {
+	ctx := context.Background()
+	s := newMemStore("")
+	if _, err := s.Get(ctx, "a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get missing: err = %v, want ErrNotFound", err)
+	}
+	if err := s.Create(ctx, Task{ID: "a", Title: "first", Version: 1}, Task{ID: "b", Version: 1}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := s.Create(ctx, Task{ID: "a"}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Create duplicate: err = %v, want ErrConflict", err)
+	}
+	if got, err := s.Get(ctx, "a"); err != nil || got.Title != "first" {
+		t.Fatalf("Get = %+v, %v; want title first", got, err)
+	}
+	if list, err := s.List(ctx); err != nil || len(list) != 2 {
+		t.Fatalf("List = %d tasks, %v; want 2", len(list), err)
+	}
+	updated, err := s.Update(ctx, "a", func(t *Task) error {
+		t.Title = "renamed"
+		return nil
+	})
+	if err != nil || updated.Title != "renamed" || updated.Version != 2 {
+		t.Fatalf("Update = %+v, %v; want title renamed, version 2", updated, err)
+	}
+	if _, err := s.Update(ctx, "missing", func(*Task) error { return nil }); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Update missing: err = %v, want ErrNotFound", err)
+	}
+	if archived, err := s.Archive(ctx, "a"); err != nil || !archived.Archived || archived.Version != 3 {
+		t.Fatalf("Archive = %+v, %v; want archived, version 3", archived, err)
+	}
+	if _, err := s.Archive(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Archive missing: err = %v, want ErrNotFound", err)
+	}
+	if list, _ := s.List(ctx); len(list) != 2 {
+		t.Fatalf("List after archive = %d tasks, want 2", len(list))
+	}
+}
+
+func TestMemStorePersistence(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "tasks.json")
+	s := newMemStore(path)
+	if err := s.Create(ctx, Task{ID: "a", Title: "kept", Version: 1}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	reloaded := newMemStore(path)
+	if err := reloaded.load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got, err := reloaded.Get(ctx, "a"); err != nil || got.Title != "kept" {
+		t.Fatalf("Get after reload = %+v, %v; want title kept", got, err)
+	}
+}
+
+func TestPersistFailureIsReported(t *testing.T) {
+	store := newMemStore(filepath.Join(t.TempDir(), "missing", "tasks.json"))
+	if err := store.Create(context.Background(), Task{ID: "a", Version: 1}); err == nil {
+		t.Fatal("Create into an unwritable path: want error")
+	}
+	h := newServer(store, 1<<20, 64<<20).routes()
+	if rec := do(h, http.MethodPost, "/tasks", `{"id":"b"}`); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("POST status = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestListEmpty(t *testing.T) {
+	rec := do(newTestHandler(t), http.MethodGet, "/tasks", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got := strings.TrimSpace(rec.Body.String()); got != "[]" {
+		t.Fatalf("body = %s, want []", got)
+	}
+	if got := rec.Header().Get("X-Total-Count"); got != "0" {
+		t.Fatalf("X-Total-Count = %q, want 0", got)
+	}
+}
+
+func TestListPopulated(t *testing.T) {
+	h := newTestHandler(t,
+		Task{ID: "b", Title: "Write docs", Status: "done"},
+		Task{ID: "a", Title: "Deploy", Status: "todo"},
+		Task{ID: "c", Title: "Deploy again", Status: "todo"},
+	)
+	tests := []struct {
+		name string
+		path string
+		want []string
+	}{
+		{"all sorted by id", "/tasks", []string{"a", "b", "c"}},
+		{"status filter", "/tasks?status=todo", []string{"a", "c"}},
+		{"unknown status", "/tasks?status=nope", []string{}},
+		{"search", "/tasks?q=DEPLOY&status=todo", []string{"a", "c"}},
+		{"limit and offset", "/tasks?limit=1&offset=1", []string{"b"}},
+		{"sort by title", "/tasks?sort=title", []string{"a", "c", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(h, http.MethodGet, tt.path, "")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+			}
+			var got []Task
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			ids := make([]string, len(got))
+			for i, task := range got {
+				ids[i] = task.ID
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("ids = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestListJSONL(t *testing.T) {
+	h := newTestHandler(t, Task{ID: "a", Status: "todo"}, Task{ID: "b", Status: "done"})
+	rec := do(h, http.MethodGet, "/tasks?format=jsonl", "")
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("Content-Type = %q, want application/x-ndjson", ct)
+	}
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %q", len(lines), rec.Body)
+	}
+	for _, line := range lines {
+		var task Task
+		if err := json.Unmarshal([]byte(line), &task); err != nil {
+			t.Fatalf("decode %q: %v", line, err)
+		}
+	}
+}
+
+func TestListJSONLIsUnpaged(t *testing.T) {
+	seed := make([]Task, maxLimit+50)
+	for i := range seed {
+		seed[i] = Task{ID: fmt.Sprintf("t%04d", i), Status: "todo"}
+	}
+	h := newTestHandler(t, seed...)
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/tasks?format=jsonl", len(seed)},
+		{"/tasks?format=jsonl&limit=1020", 1020},
+		{"/tasks?format=jsonl&offset=1040", 10},
+		{"/tasks", defaultLimit},
+		{"/tasks?limit=5000", maxLimit},
+	}
+	for _, tt := range tests {
+		rec := do(h, http.MethodGet, tt.path, "")
+		var got int
+		if strings.Contains(tt.path, "jsonl") {
+			got = strings.Count(rec.Body.String(), "\n")
+		} else {
+			var list []Task
+			json.NewDecoder(rec.Body).Decode(&list)
+			got = len(list)
+		}
+		if got != tt.want {
+			t.Errorf("%s: %d tasks, want %d", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCount(t *testing.T) {
+	h := newTestHandler(t,
+		Task{ID: "a", Status: "todo"},
+		Task{ID: "b", Status: "done"},
+		Task{ID: "c", Status: "done"},
+	)
+	tests := []struct {
+		path  string
+		total int
+		by    map[string]int
+	}{
+		{"/tasks/count", 3, map[string]int{"todo": 1, "in_progress": 0, "done": 2}},
+		{"/tasks/count?status=done", 2, map[string]int{"done": 2}},
+	}
+	for _, tt := range tests {
+		rec := do(h, http.MethodGet, tt.path, "")
+		var got TaskCounts
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: decode: %v", tt.path, err)
+		}
+		if got.Total != tt.total || len(got.ByStatus) != len(tt.by) {
+			t.Fatalf("%s: counts = %+v, want total %d by %v", tt.path, got, tt.total, tt.by)
+		}
+		for k, v := range tt.by {
+			if got.ByStatus[k] != v {
+				t.Fatalf("%s: by_status[%s] = %d, want %d", tt.path, k, got.ByStatus[k], v)
+			}
+		}
+	}
+}
+
+func TestTransition(t *testing.T) {
+	h := newTestHandler(t, Task{ID: "a", Status: "todo"}, Task{ID: "b", Status: "in_progress"})
+	rec := do(h, http.MethodPost, "/tasks/transition", `{"ids":["a","b","zz"],"status":"done"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d (body %s)", rec.Code, http.StatusOK, rec.Body)
+	}
+	var got transitionResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if strings.Join(got.Updated, ",") != "a,b" || strings.Join(got.NotFound, ",") != "zz" {
+		t.Fatalf("result = %+v, want updated [a b] and not_found [zz]", got)
+	}
+	if got := do(h, http.MethodGet, "/tasks?status=done", "").Header().Get("X-Total-Count"); got != "2" {
+		t.Fatalf("done count = %s, want 2", got)
+	}
+	if rec := do(h, http.MethodPost, "/tasks/transition", `{"ids":["a"],"status":"nope"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid status: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestCreateTask(t *testing.T) {
+	h := newTestHandler(t)
+	rec := do(h, http.MethodPost, "/tasks", `{"id":"a","title":"Write tests"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusCreated)
+	}
+	if got := rec.Header().Get("Location"); got != "/tasks/a" {
+		t.Fatalf("Location = %q, want /tasks/a", got)
+	}
+	var created Task
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if created.Status != "todo" || created.CreatedAt.IsZero() {
+		t.Fatalf("created = %+v, want default status and timestamps", created)
+	}
+
+	rec = do(h, http.MethodGet, "/tasks/a", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("get status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var got Task
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.Title != "Write tests" {
+		t.Fatalf("title = %q, want %q", got.Title, "Write tests")
+	}
+}
+
+func TestCreateDryRun(t *testing.T) {
+	h := newTestHandler(t, Task{ID: "a", Status: "todo"})
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"valid", `{"id":"b"}`, http.StatusOK},
+		{"valid batch", `[{"id":"b"},{"id":"c","parent_id":"b"}]`, http.StatusOK},
+		{"duplicate", `{"id":"a"}`, http.StatusConflict},
+		{"invalid status", `{"id":"b","status":"nope"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rec := do(h, http.MethodPost, "/tasks?dryRun=true", tt.body); rec.Code != tt.want {
+			t.Fatalf("%s: status = %d, want %d (body %s)", tt.name, rec.Code, tt.want, rec.Body)
+		}
+	}
+	if got := do(h, http.MethodGet, "/tasks", "").Header().Get("X-Total-Count"); got != "1" {
+		t.Fatalf("X-Total-Count = %q after dry runs, want 1", got)
+	}
+}
+
+func TestStatusCodes(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		body      string
+		want      int
+		wantError string
+	}{
+		{"malformed json", http.MethodPost, "/tasks", `{"id":`, http.StatusBadRequest, "invalid json"},
+		{"invalid status", http.MethodPost, "/tasks", `{"id":"x","status":"done!"}`, http.StatusBadRequest, "invalid status"},
+		{"invalid priority", http.MethodPost, "/tasks", `{"id":"x","priority":9}`, http.StatusBadRequest, "invalid priority"},
+		{"duplicate id", http.MethodPost, "/tasks", `{"id":"a"}`, http.StatusConflict, "task already exists"},
+		{"duplicate in batch", http.MethodPost, "/tasks", `[{"id":"x"},{"id":"x"}]`, http.StatusBadRequest, "duplicate id"},
+		{"reserved id", http.MethodPost, "/tasks", `{"id":"count"}`, http.StatusBadRequest, "reserved"},
+		{"reserved id in import", http.MethodPost, "/tasks/import", `[{"id":"export"}]`, http.StatusBadRequest, "reserved"},
+		{"dot id", http.MethodPost, "/tasks", `{"id":"."}`, http.StatusBadRequest, "not a valid path segment"},
+		{"dot-dot import id", http.MethodPost, "/tasks/import", `[{"id":".."}]`, http.StatusBadRequest, "not a valid path segment"},
+		{"slash in id", http.MethodPost, "/tasks", `{"id":"a/b"}`, http.StatusBadRequest, "must not contain"},
+		{"slash in import id", http.MethodPost, "/tasks/import", `[{"id":"a/b"}]`, http.StatusBadRequest, "must not contain"},
+		{"negative limit", http.MethodGet, "/tasks?limit=-1", "", http.StatusBadRequest, "invalid limit"},
+		{"clear without confirm", http.MethodDelete, "/tasks", "", http.StatusBadRequest, "confirm=true"},
+		{"collection method", http.MethodPatch, "/tasks", "", http.StatusMethodNotAllowed, "method not allowed"},
+		{"missing id", http.MethodGet, "/tasks/", "", http.StatusBadRequest, "missing task id"},
+		{"get missing", http.MethodGet, "/tasks/nope", "", http.StatusNotFound, "task not found"},
+		{"put missing", http.MethodPut, "/tasks/nope", `{"status":"todo","version":1}`, http.StatusNotFound, "task not found"},
+		{"patch missing", http.MethodPatch, "/tasks/nope", `{}`, http.StatusNotFound, "task not found"},
+		{"put missing without version", http.MethodPut, "/tasks/nope", `{"status":"todo"}`, http.StatusNotFound, "task not found"},
+		{"patch missing without version", http.MethodPatch, "/tasks/nope", `{"status":"done"}`, http.StatusNotFound, "task not found"},
+		{"put without version", http.MethodPut, "/tasks/a", `{"status":"done"}`, http.StatusPreconditionRequired, "version"},
+		{"put stale version", http.MethodPut, "/tasks/a", `{"status":"done","version":2}`, http.StatusConflict, "version mismatch"},
+		{"patch stale version", http.MethodPatch, "/tasks/a", `{"status":"done","version":7}`, http.StatusConflict, "version mismatch"},
+		{"delete missing", http.MethodDelete, "/tasks/nope", "", http.StatusNotFound, "task not found"},
+		{"unknown route", http.MethodGet, "/nope", "", http.StatusNotFound, "not found"},
+		{"put", http.MethodPut, "/tasks/a", `{"title":"new","status":"done","version":1}`, http.StatusOK, ""},
+		{"patch", http.MethodPatch, "/tasks/a", `{"status":"in_progress","version":1}`, http.StatusOK, ""},
+		{"delete", http.MethodDelete, "/tasks/a", "", http.StatusNoContent, ""},
+		{"clear", http.MethodDelete, "/tasks?confirm=true", "", http.StatusNoContent, ""},
+		{"healthz", http.MethodGet, "/healthz", "", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t, Task{ID: "a", Title: "seed", Status: "todo", Version: 1})
+			rec := do(h, tt.method, tt.path, tt.body)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d (body %s)", rec.Code, tt.want, rec.Body)
+			}
+			if tt.wantError == "" {
+				return
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Fatalf("Content-Type = %q, want application/json", ct)
+			}
+			var got errorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decode error body: %v", err)
+			}
+			if got.Status != tt.want || !strings.Contains(got.Error, tt.wantError) {
+				t.Fatalf("error = %+v, want status %d containing %q", got, tt.want, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestParentChild(t *testing.T) {
+	h := newTestHandler(t, Task{ID: "root", Status: "todo", Version: 1})
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"child", http.MethodPost, "/tasks", `{"id":"a","parent_id":"root"}`, http.StatusCreated},
+		{"grandchild", http.MethodPost, "/tasks", `{"id":"b","parent_id":"a"}`, http.StatusCreated},
+		{"missing parent", http.MethodPost, "/tasks", `{"id":"c","parent_id":"nope"}`, http.StatusBadRequest},
+		{"self parent", http.MethodPost, "/tasks", `{"id":"d","parent_id":"d"}`, http.StatusBadRequest},
+		{"batch cycle", http.MethodPost, "/tasks", `[{"id":"e","parent_id":"f"},{"id":"f","parent_id":"e"}]`, http.StatusBadRequest},
+		{"cycle via patch", http.MethodPatch, "/tasks/root", `{"parent_id":"b","version":1}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rec := do(h, tt.method, tt.path, tt.body); rec.Code != tt.want {
+			t.Fatalf("%s: status = %d, want %d (body %s)", tt.name, rec.Code, tt.want, rec.Body)
+		}
+	}
+
+	rec := do(h, http.MethodGet, "/tasks/root/children", "")
+	var children []Task
+	if err := json.Unmarshal(rec.Body.Bytes(), &children); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(children) != 1 || children[0].ID != "a" {
+		t.Fatalf("children = %+v, want only a", children)
+	}
+	if rec := do(h, http.MethodGet, "/tasks/nope/children", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("children of missing task: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	h := newTestHandler(t, Task{ID: "a", Status: "todo", Version: 1}, Task{ID: "b", Status: "todo", Version: 1})
+	if rec := do(h, http.MethodDelete, "/tasks/a", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if got := do(h, http.MethodGet, "/tasks", "").Header().Get("X-Total-Count"); got != "1" {
+		t.Fatalf("default list count = %s, want 1", got)
+	}
+	if got := do(h, http.MethodGet, "/tasks?includeArchived=true", "").Header().Get("X-Total-Count"); got != "2" {
+		t.Fatalf("includeArchived list count = %s, want 2", got)
+	}
+	if rec := do(h, http.MethodPatch, "/tasks/a", `{"archived":false,"version":2}`); rec.Code != http.StatusOK {
+		t.Fatalf("restore status = %d, want %d (body %s)", rec.Code, http.StatusOK, rec.Body)
+	}
+	if got := do(h, http.MethodGet, "/tasks", "").Header().Get("X-Total-Count"); got != "2" {
+		t.Fatalf("list count after restore = %s, want 2", got)
+	}
+}
+
+func TestAssigneeFilter(t *testing.T) {
+	h := newTestHandler(t,
+		Task{ID: "a", Status: "todo", Assignee: "alice"},
+		Task{ID: "b", Status: "todo", Assignee: "bob"},
+		Task{ID: "c", Status: "todo"},
+	)
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/tasks?assignee=alice", []string{"a"}},
+		{"/tasks?assignee=", []string{"c"}},
+		{"/tasks?assignee=bob", []string{"b"}},
+		{"/tasks", []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		var got []Task
+		json.NewDecoder(do(h, http.MethodGet, tt.path, "").Body).Decode(&got)
+		ids := make([]string, len(got))
+		for i, task := range got {
+			ids[i] = task.ID
+		}
+		if strings.Join(ids, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: ids = %v, want %v", tt.path, ids, tt.want)
+		}
+	}
+	if rec := do(h, http.MethodGet, "/tasks?assignee=me", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("assignee=me: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	src := newTestHandler(t,
+		Task{ID: "a", Title: "parent", Status: "todo", Version: 3, CreatedAt: ts, UpdatedAt: ts},
+		Task{ID: "b", Title: "child", Status: "done", Version: 1, ParentID: "a", CreatedAt: ts, UpdatedAt: ts},
+	)
+	backup := do(src, http.MethodGet, "/tasks/export", "").Body.String()
+
+	dst := newTestHandler(t, Task{ID: "old", Status: "todo", Version: 1})
+	rec := do(dst, http.MethodPost, "/tasks/import", backup)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("import status = %d, want %d (body %s)", rec.Code, http.StatusOK, rec.Body)
+	}
+	var resp importResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.Imported != 2 {
+		t.Fatalf("imported = %d, want 2", resp.Imported)
+	}
+	if got := do(dst, http.MethodGet, "/tasks/export", "").Body.String(); got != backup {
+		t.Fatalf("export after import = %s, want %s", got, backup)
+	}
+
+	for _, body := range []string{
+		`[{"id":"x","status":"bogus"}]`,
+		`[{"id":"x","parent_id":"missing"}]`,
+		`[{"id":"x"},{"id":"x"}]`,
+	} {
+		if rec := do(dst, http.MethodPost, "/tasks/import", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("import %s: status = %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+	if got := do(dst, http.MethodGet, "/tasks/export", "").Body.String(); got != backup {
+		t.Fatalf("rejected import modified store: %s", got)
+	}
+}
+
+func TestDeletePublishesDeletedEvent(t *testing.T) {
+	store := newMemStore("")
+	store.Create(context.Background(), Task{ID: "a", Status: "todo", Version: 1})
+	s := newServer(store, 1<<20, 64<<20)
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+	if rec := do(s.routes(), http.MethodDelete, "/tasks/a", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	select {
+	case ev := <-ch:
+		if ev.Type != "deleted" || ev.ID != "a" || ev.Task == nil || !ev.Task.Archived {
+			t.Fatalf("event = %+v, want deleted a carrying the archived task", ev)
+		}
+	default:
+		t.Fatal("no event published")
+	}
+}
+
+func TestImportAboveBodyLimit(t *testing.T) {
+	const maxBody = 1024
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	seed := make([]Task, 50)
+	for i := range seed {
+		seed[i] = Task{ID: fmt.Sprintf("t%02d", i), Title: "a task title long enough to add up", Status: "todo", Version: 1, CreatedAt: ts, UpdatedAt: ts}
+	}
+	src := newMemStore("")
+	src.Create(context.Background(), seed...)
+	backup := do(newServer(src, maxBody, 1<<20).routes(), http.MethodGet, "/tasks/export", "").Body.String()
+	if len(backup) <= maxBody {
+		t.Fatalf("backup is %d bytes, want more than %d", len(backup), maxBody)
+	}
+
+	h := newServer(newMemStore(""), maxBody, 1<<20).routes()
+	if rec := do(h, http.MethodPost, "/tasks", backup); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("POST /tasks status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+	if rec := do(h, http.MethodPost, "/tasks/import", backup); rec.Code != http.StatusOK {
+		t.Fatalf("import status = %d, want %d (body %s)", rec.Code, http.StatusOK, rec.Body)
+	}
+	if got := do(h, http.MethodGet, "/tasks/export", "").Body.String(); got != backup {
+		t.Fatal("export after import differs from backup")
+	}
+
+	small := newServer(newMemStore(""), maxBody, maxBody).routes()
+	if rec := do(small, http.MethodPost, "/tasks/import", backup); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("import above max-import: status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestImportResetsIdempotency(t *testing.T) {
+	h := newTestHandler(t)
+	post := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/tasks", strings.NewReader(`{"id":"x","title":"original"}`))
+		req.Header.Set("Idempotency-Key", "k1")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := post(); code != http.StatusCreated {
+		t.Fatalf("first POST status = %d, want %d", code, http.StatusCreated)
+	}
+	if rec := do(h, http.MethodPost, "/tasks/import", `[{"id":"x","title":"imported","status":"todo"}]`); rec.Code != http.StatusOK {
+		t.Fatalf("import status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if code := post(); code != http.StatusConflict {
+		t.Fatalf("retried POST after import status = %d, want %d (no replay)", code, http.StatusConflict)
+	}
+}
+
+func TestChildrenHideArchived(t *testing.T) {
+	h := newTestHandler(t,
+		Task{ID: "p", Status: "todo", Version: 1},
+		Task{ID: "c", Status: "todo", Version: 1, ParentID: "p"},
+		Task{ID: "d", Status: "todo", Version: 1, ParentID: "p"},
+	)
+	do(h, http.MethodDelete, "/tasks/c", "")
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/tasks/p/children", "d"},
+		{"/tasks/p/children?includeArchived=true", "c,d"},
+	}
+	for _, tt := range tests {
+		var children []Task
+		json.NewDecoder(do(h, http.MethodGet, tt.path, "").Body).Decode(&children)
+		ids := make([]string, len(children))
+		for i, c := range children {
+			ids[i] = c.ID
+		}
+		if got := strings.Join(ids, ","); got != tt.want {
+			t.Errorf("%s: children = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPatchEmptyBodyKeepsFields(t *testing.T) {
+	h := newTestHandler(t, Task{ID: "a", Title: "keep me", Status: "done", Priority: 3})
+	rec := do(h, http.MethodPatch, "/tasks/a", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var got Task
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.Title != "keep me" || got.Status != "done" || got.Priority != 3 {
+		t.Fatalf("task = %+v, want fields unchanged", got)
+	}
+}
+
+func TestVersionIncrements(t *testing.T) {
+	h := newTestHandler(t)
+	do(h, http.MethodPost, "/tasks", `{"id":"a"}`)
+	req := httptest.NewRequest(http.MethodPatch, "/tasks/a", strings.NewReader(`{"status":"done"}`))
+	req.Header.Set("If-Match", `"1"`)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d (body %s)", rec.Code, http.StatusOK, rec.Body)
+	}
+	var got Task
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.Version != 2 {
+		t.Fatalf("version = %d, want 2", got.Version)
+	}
+	if rec := do(h, http.MethodPatch, "/tasks/a", `{"status":"todo","version":1}`); rec.Code != http.StatusConflict {
+		t.Fatalf("stale patch status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	h := newTestHandler(t, Task{ID: "a", Status: "todo"})
+	rec := do(h, http.MethodGet, "/tasks/a", "")
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("missing ETag")
+	}
+	req := httptest.NewRequest(http.MethodGet, "/tasks/a", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusNotModified)
+	}
+	if rec.Body.Len() != 0 {
+		t.Fatalf("body = %q, want empty", rec.Body)
+	}
+}
+
+func TestPatchWithETag(t *testing.T) {
+	h := newTestHandler(t, Task{ID: "a", Status: "todo", Version: 1})
+	etag := do(h, http.MethodGet, "/tasks/a", "").Header().Get("ETag")
+
+	req := httptest.NewRequest(http.MethodPatch, "/tasks/a", strings.NewReader(`{"status":"done"}`))
+	req.Header.Set("If-Match", etag)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("patch with ETag %s: status = %d, want %d (body %s)", etag, rec.Code, http.StatusOK, rec.Body)
+	}
+
+	req = httptest.NewRequest(http.MethodPatch, "/tasks/a", strings.NewReader(`{"status":"todo"}`))
+	req.Header.Set("If-Match", etag)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("patch with stale ETag: status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+	if got := do(h, http.MethodGet, "/tasks/a", "").Header().Get("ETag"); got == etag {
+		t.Fatalf("ETag unchanged after update: %s", got)
+	}
+}
+
+func TestETagAfterVersionReset(t *testing.T) {
+	h := newTestHandler(t, Task{ID: "a", Title: "one", Status: "todo", Version: 1})
+	etag := do(h, http.MethodGet, "/tasks/a", "").Header().Get("ETag")
+	do(h, http.MethodDelete, "/tasks?confirm=true", "")
+	if rec := do(h, http.MethodPost, "/tasks", `{"id":"a","title":"two"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("re-create status = %d, want %d", rec.Code, http.StatusCreated)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/tasks/a", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"two"`) {
+		t.Fatalf("conditional GET with old ETag: status = %d body = %s, want 200 with new content", rec.Code, rec.Body)
+	}
+
+	req = httptest.NewRequest(http.MethodPatch, "/tasks/a", strings.NewReader(`{"status":"done"}`))
+	req.Header.Set("If-Match", etag)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("PATCH with old ETag: status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+func writeClientFrame(w io.Writer, op byte, payload []byte) error {
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x80 | op, 0x80 | byte(len(payload))}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+func readServerFrame(r *bufio.Reader) (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(hdr[1] & 0x7f)
+	if n == 126 {
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, n)
+	_, err := io.ReadFull(r, payload)
+	return hdr[0] & 0x0f, payload, err
+}
+
+func TestWebSocket(t *testing.T) {
+	srv := httptest.NewServer(newTestHandler(t))
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /tasks/ws HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	if got, want := resp.Header.Get("Sec-WebSocket-Accept"), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; got != want {
+		t.Fatalf("Sec-WebSocket-Accept = %q, want %q", got, want)
+	}
+
+	if err := writeClientFrame(conn, wsText, []byte(`{"type":"create","task":{"id":"a","title":"over ws"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	op, payload, err := readServerFrame(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ev taskEvent
+	if err := json.Unmarshal(payload, &ev); err != nil || op != wsText {
+		t.Fatalf("frame op=%d payload=%s err=%v", op, payload, err)
+	}
+	if ev.Type != "created" || ev.ID != "a" {
+		t.Fatalf("event = %+v, want created a", ev)
+	}
+
+	writeClientFrame(conn, wsText, []byte(`{"type":"update","id":"a","patch":{"status":"done"}}`))
+	_, payload, err = readServerFrame(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e errorResponse
+	json.Unmarshal(payload, &e)
+	if e.Status != http.StatusPreconditionRequired {
+		t.Fatalf("update without version: %s, want status %d", payload, http.StatusPreconditionRequired)
+	}
+
+	writeClientFrame(conn, wsClose, binary.BigEndian.AppendUint16(nil, wsCloseNormal))
+	if op, _, err := readServerFrame(br); err != nil || op != wsClose {
+		t.Fatalf("close reply op=%d err=%v, want close frame", op, err)
+	}
+}
+
+func TestMetricsFoldsUnknownMethods(t *testing.T) {
+	m := newMetrics()
+	for _, method := range []string{"GET", "FOO1", "FOO2"} {
+		m.observe(method, "/tasks", http.StatusOK, time.Millisecond)
+	}
+	if len(m.requests) != 2 {
+		t.Fatalf("requests = %v, want GET and OTHER only", m.requests)
+	}
+	if got := m.requests[requestKey{"OTHER", http.StatusOK}]; got != 2 {
+		t.Fatalf("OTHER count = %d, want 2", got)
+	}
+}
+
+func TestIdempotencyKeyLock(t *testing.T) {
+	c := newIdempotencyCache()
+	unlockA := c.lock("a")
+
+	other := make(chan struct{})
+	go func() {
+		c.lock("b")()
+		close(other)
+	}()
+	select {
+	case <-other:
+	case <-time.After(time.Second):
+		t.Fatal("lock on a different key blocked")
+	}
+
+	same := make(chan struct{})
+	go func() {
+		c.lock("a")()
+		close(same)
+	}()
+	select {
+	case <-same:
+		t.Fatal("lock on the same key did not wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlockA()
+	<-same
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.inflight) != 0 {
+		t.Fatalf("inflight = %v, want empty", c.inflight)
+	}
+}
+
+func writeConfig(t *testing.T, name, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func parseTestConfig(args ...string) (config, error) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return parseConfig(fs, args)
+}
+
+func TestParseConfig(t *testing.T) {
+	path := writeConfig(t, "server.json", `{"addr":":9000","burst":5,"read_timeout":"3s"}`)
+
+	cfg, err := parseTestConfig("-config", path)
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if cfg.Addr != ":9000" || cfg.Burst != 5 || cfg.ReadTimeout.Duration != 3*time.Second {
+		t.Fatalf("file values not applied: %+v", cfg)
+	}
+	if def := defaultConfig(); cfg.MaxBody != def.MaxBody || cfg.CORSOrigin != def.CORSOrigin {
+		t.Fatalf("unset fields lost their defaults: %+v", cfg)
+	}
+
+	cfg, err = parseTestConfig("-burst", "7", "-config", path)
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if cfg.Burst != 7 || cfg.Addr != ":9000" {
+		t.Fatalf("explicit flag should override file: burst=%d addr=%s", cfg.Burst, cfg.Addr)
+	}
+
+	if _, err := parseTestConfig("-rate", "1", "-burst", "0"); err == nil || !strings.Contains(err.Error(), "burst") {
+		t.Fatalf("-rate 1 -burst 0: err = %v, want burst error", err)
+	}
+}
+
+func TestParseConfigRejects(t *testing.T) {
+	tests := []struct {
+		name, file, body, wantError string
+	}{
+		{"unknown key", "server.json", `{"adress":":9000"}`, "unknown field"},
+		{"yaml file", "server.yaml", "addr: :9000\n", "only JSON is supported"},
+		{"bad duration", "server.json", `{"read_timeout":15}`, "duration must be a string"},
+		{"zero burst", "server.json", `{"rate":5,"burst":0}`, "burst must be at least 1"},
+		{"zero proxy hops", "server.json", `{"trust_proxy":true,"proxy_hops":0}`, "proxy-hops must be at least 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTestConfig("-config", writeConfig(t, tt.file, tt.body))
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Fatalf("err = %v, want it to contain %q", err, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var logs bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	defer slog.SetDefault(prev)
+
+	h := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestLogger(r.Context()).Info("probe")
+	}))
+	tests := []struct {
+		name, in string
+		echoed   bool
+	}{
+		{"valid", "abc-123", true},
+		{"missing", "", false},
+		{"invalid", "bad id", false},
+		{"oversized", strings.Repeat("x", maxRequestIDLen+1), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.in != "" {
+				req.Header.Set("X-Request-ID", tt.in)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			got := rec.Header().Get("X-Request-ID")
+			if tt.echoed && got != tt.in {
+				t.Fatalf("X-Request-ID = %q, want %q echoed", got, tt.in)
+			}
+			if !tt.echoed && (got == tt.in || !validRequestID(got)) {
+				t.Fatalf("X-Request-ID = %q, want a generated replacement for %q", got, tt.in)
+			}
+			var entry struct {
+				RequestID string `json:"request_id"`
+			}
+			if err := json.Unmarshal(logs.Bytes(), &entry); err != nil || entry.RequestID != got {
+				t.Fatalf("logged request_id = %q (err %v), want %q", entry.RequestID, err, got)
+			}
+		})
+	}
+}
+
+func TestMetricsSkipsStreamDurations(t *testing.T) {
+	m := newMetrics()
+	m.observe(http.MethodGet, "/tasks", http.StatusOK, time.Millisecond)
+	m.observe(http.MethodGet, "/tasks/stream", http.StatusOK, time.Hour)
+	m.observe(http.MethodGet, "/tasks/ws", http.StatusOK, time.Hour)
+	if m.count != 1 || m.sum > 1 {
+		t.Fatalf("histogram count = %d, sum = %g; want only the /tasks request", m.count, m.sum)
+	}
+	if got := m.requests[requestKey{http.MethodGet, http.StatusOK}]; got != 3 {
+		t.Fatalf("request counter = %d, want 3", got)
+	}
+}
+
+func TestBrokerDropsSlowSubscriber(t *testing.T) {
+	b := newBroker()
+	slow := b.subscribe()
+	fast := b.subscribe()
+	defer b.unsubscribe(fast)
+	n := cap(slow) + 1
+	for i := 0; i < n; i++ {
+		b.publish(taskEvent{Type: "updated", ID: strconv.Itoa(i)})
+		<-fast
+	}
+	got := 0
+	for range slow {
+		got++
+	}
+	if got != cap(slow) {
+		t.Fatalf("slow subscriber got %d events before close, want %d", got, cap(slow))
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[slow]; ok {
+		t.Fatal("slow subscriber still registered")
+	}
+	if _, ok := b.subs[fast]; !ok {
+		t.Fatal("fast subscriber was dropped")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name string
+		hops int
+		xff  []string
+		want string
+	}{
+		{"untrusted ignores header", 0, []string{"1.1.1.1"}, "10.0.0.9"},
+		{"one proxy uses rightmost", 1, []string{"6.6.6.6, 2.2.2.2"}, "2.2.2.2"},
+		{"two proxies", 2, []string{"6.6.6.6, 2.2.2.2", "10.0.0.5"}, "2.2.2.2"},
+		{"too few entries", 2, []string{"2.2.2.2"}, "10.0.0.9"},
+		{"no header", 1, nil, "10.0.0.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/tasks", nil)
+			req.RemoteAddr = "10.0.0.9:4321"
+			for _, v := range tt.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if got := newRateLimiter(1, 1, tt.hops).clientIP(req); got != tt.want {
+				t.Fatalf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "ok")
+})
+
+func TestRequireToken(t *testing.T) {
+	h := requireToken("secret", okHandler)
+	tests := []struct {
+		name, path, auth string
+		want             int
+	}{
+		{"missing token", "/tasks", "", http.StatusUnauthorized},
+		{"wrong token", "/tasks", "Bearer nope", http.StatusUnauthorized},
+		{"wrong scheme", "/tasks", "Basic secret", http.StatusUnauthorized},
+		{"valid token", "/tasks", "Bearer secret", http.StatusOK},
+		{"healthz exempt", "/healthz", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Fatalf("WWW-Authenticate = %q, want Bearer", rec.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	h := newRateLimiter(1, 2, 0).limit(okHandler)
+	tests := []struct {
+		name, path string
+		want       int
+		retryAfter string
+	}{
+		{"first", "/tasks", http.StatusOK, ""},
+		{"burst", "/tasks", http.StatusOK, ""},
+		{"limited", "/tasks", http.StatusTooManyRequests, "1"},
+		{"healthz exempt", "/healthz", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want || rec.Header().Get("Retry-After") != tt.retryAfter {
+			t.Fatalf("%s: status = %d, Retry-After = %q; want %d, %q",
+				tt.name, rec.Code, rec.Header().Get("Retry-After"), tt.want, tt.retryAfter)
+		}
+	}
+}
+
+func TestRateLimiterEvictsIdle(t *testing.T) {
+	l := newRateLimiter(1, 1, 0)
+	now := time.Now()
+	l.allow("a", now)
+	l.allow("b", now.Add(limiterIdleTTL))
+	l.evictIdle(now.Add(limiterIdleTTL + time.Second))
+	if _, ok := l.buckets["a"]; ok {
+		t.Fatal("idle bucket a was not evicted")
+	}
+	if _, ok := l.buckets["b"]; !ok {
+		t.Fatal("recent bucket b was evicted")
+	}
+}
+
+func TestGzip(t *testing.T) {
+	large := strings.Repeat("task ", gzipMinSize)
+	tests := []struct {
+		name, body, accept string
+		status             int
+		wantGzip           bool
+	}{
+		{"small body passthrough", "tiny", "gzip", http.StatusOK, false},
+		{"large body compressed", large, "gzip", http.StatusOK, true},
+		{"not accepted", large, "", http.StatusOK, false},
+		{"q=0 refused", large, "gzip;q=0", http.StatusOK, false},
+		{"not modified passthrough", "", "gzip", http.StatusNotModified, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := withGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/tasks", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept-Encoding", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Fatalf("Vary = %q, want Accept-Encoding", got)
+			}
+			gzipped := rec.Header().Get("Content-Encoding") == "gzip"
+			if gzipped != tt.wantGzip {
+				t.Fatalf("Content-Encoding gzip = %v, want %v", gzipped, tt.wantGzip)
+			}
+			body := rec.Body.Bytes()
+			if gzipped {
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(body) != tt.body {
+				t.Fatalf("body length = %d, want %d", len(body), len(tt.body))
+			}
+		})
+	}
+}
+
+func TestCORS(t *testing.T) {
+	tests := []struct {
+		name, method, requestMethod string
+		want                        int
+		wantNext                    bool
+	}{
+		{"preflight", http.MethodOptions, http.MethodPatch, http.StatusNoContent, false},
+		{"plain options", http.MethodOptions, "", http.StatusOK, true},
+		{"simple request", http.MethodGet, "", http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			h := withCORS("https://example.com", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			}))
+			req := httptest.NewRequest(tt.method, "/tasks", nil)
+			if tt.requestMethod != "" {
+				req.Header.Set("Access-Control-Request-Method", tt.requestMethod)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want || called != tt.wantNext {
+				t.Fatalf("status = %d, next called = %v; want %d, %v", rec.Code, called, tt.want, tt.wantNext)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://example.com" {
+				t.Fatalf("Access-Control-Allow-Origin = %q", got)
+			}
+			if !strings.Contains(rec.Header().Get("Access-Control-Allow-Methods"), http.MethodPatch) {
+				t.Fatalf("Access-Control-Allow-Methods = %q, want PATCH", rec.Header().Get("Access-Control-Allow-Methods"))
+			}
+		})
+	}
+}
+
+func TestStream(t *testing.T) {
+	srv := httptest.NewServer(newTestHandler(t))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/tasks/stream", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+	}
+
+	post, err := http.Post(srv.URL+"/tasks", "application/json", strings.NewReader(`{"id":"a","title":"streamed"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	post.Body.Close()
+
+	sc := bufio.NewScanner(resp.Body)
+	var event, data string
+	for sc.Scan() && (event == "" || data == "") {
+		line := sc.Text()
+		if v, ok := strings.CutPrefix(line, "event: "); ok {
+			event = v
+		}
+		if v, ok := strings.CutPrefix(line, "data: "); ok {
+			data = v
+		}
+	}
+	if event != "created" {
+		t.Fatalf("event = %q, want created (scan err %v)", event, sc.Err())
+	}
+	var ev taskEvent
+	if err := json.Unmarshal([]byte(data), &ev); err != nil || ev.ID != "a" || ev.Task == nil || ev.Task.Title != "streamed" {
+		t.Fatalf("data = %s (err %v), want created task a", data, err)
+	}
+}